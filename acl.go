@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type aclRole struct {
+	permissions map[string]bool
+	users       map[string]bool
+	channels    map[string]bool
+}
+
+func newAclRole() *aclRole {
+	return &aclRole{
+		permissions: make(map[string]bool),
+		users:       make(map[string]bool),
+		channels:    make(map[string]bool),
+	}
+}
+
+// merge adds users, permissions and channels of the other role.
+func (r *aclRole) merge(other *aclRole) {
+	for k := range other.users {
+		r.users[k] = true
+	}
+	for k := range other.permissions {
+		r.permissions[k] = true
+	}
+	for k := range other.channels {
+		r.channels[k] = true
+	}
+}
+
+// accessControlList maps stable platform user ids to permissions through roles.
+// A role without channels is valid in every channel.
+type accessControlList struct {
+	sync.RWMutex
+	// roles changed by golbot.acl functions
+	roles map[string]*aclRole
+	// roles of the acl option, replaced when the config file is reloaded
+	config map[string]*aclRole
+	logger *log.Logger
+}
+
+var acl = &accessControlList{roles: make(map[string]*aclRole), config: make(map[string]*aclRole)}
+
+// effective returns roles of the acl option merged with roles changed by
+// golbot.acl functions. The lock must be held by the caller.
+func (a *accessControlList) effective() map[string]*aclRole {
+	roles := make(map[string]*aclRole, len(a.roles)+len(a.config))
+	for _, m := range []map[string]*aclRole{a.config, a.roles} {
+		for name, r := range m {
+			if _, ok := roles[name]; !ok {
+				roles[name] = newAclRole()
+			}
+			roles[name].merge(r)
+		}
+	}
+	return roles
+}
+
+func (a *accessControlList) role(name string) *aclRole {
+	r, ok := a.roles[name]
+	if !ok {
+		r = newAclRole()
+		a.roles[name] = r
+	}
+	return r
+}
+
+func (a *accessControlList) audit(format string, args ...interface{}) {
+	if a.logger != nil {
+		a.logger.Printf(format, args...)
+	}
+}
+
+func (a *accessControlList) SetLogger(logger *log.Logger) {
+	a.Lock()
+	defer a.Unlock()
+	a.logger = logger
+}
+
+func (a *accessControlList) Grant(role, user string) {
+	a.Lock()
+	defer a.Unlock()
+	a.role(role).users[user] = true
+	a.audit("[INFO] acl: granted role '%s' to %s", role, user)
+}
+
+func (a *accessControlList) Revoke(role, user string) {
+	a.Lock()
+	defer a.Unlock()
+	for _, m := range []map[string]*aclRole{a.config, a.roles} {
+		if r, ok := m[role]; ok {
+			delete(r.users, user)
+		}
+	}
+	a.audit("[INFO] acl: revoked role '%s' from %s", role, user)
+}
+
+func (a *accessControlList) Allow(role string, permissions ...string) {
+	a.Lock()
+	defer a.Unlock()
+	r := a.role(role)
+	for _, p := range permissions {
+		r.permissions[p] = true
+	}
+}
+
+func (a *accessControlList) Restrict(role string, channels ...string) {
+	a.Lock()
+	defer a.Unlock()
+	r := a.role(role)
+	for _, c := range channels {
+		r.channels[c] = true
+	}
+}
+
+func (a *accessControlList) Check(user, channel, permission string) bool {
+	// users without stable ids have no roles
+	if len(user) == 0 {
+		return false
+	}
+	a.RLock()
+	defer a.RUnlock()
+	for _, r := range a.effective() {
+		if !r.users[user] || !r.permissions[permission] {
+			continue
+		}
+		if len(r.channels) == 0 || r.channels[channel] {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *accessControlList) Roles(user string) []string {
+	a.RLock()
+	defer a.RUnlock()
+	roles := []string{}
+	for name, r := range a.effective() {
+		if r.users[user] {
+			roles = append(roles, name)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func (a *accessControlList) Deny(e *MessageEvent, permission string) {
+	a.audit("[WARN] acl: denied '%s' to %s(%s) in %s(%s): %s", permission, e.From, e.UserId, e.Target, e.ChannelId, e.Message)
+}
+
+// SetConfig replaces roles of the acl option.
+func (a *accessControlList) SetConfig(roles map[string]*aclRole) {
+	a.Lock()
+	defer a.Unlock()
+	a.config = roles
+	a.audit("[INFO] acl: loaded %d roles", len(roles))
+}
+
+// loadAclOption replaces roles of the acl option, so users removed from the
+// config file lose their roles on reload.
+func loadAclOption(L *lua.LState, lv lua.LValue) {
+	roles := make(map[string]*aclRole)
+	tbl, ok := lv.(*lua.LTable)
+	if !ok && lv != lua.LNil {
+		L.RaiseError("acl: table expected")
+	}
+	if ok {
+		tbl.ForEach(func(key, value lua.LValue) {
+			role := key.String()
+			opt, ok := value.(*lua.LTable)
+			if !ok {
+				L.RaiseError("acl: role '%s' must be a table", role)
+			}
+			r := newAclRole()
+			for field, set := range map[string]map[string]bool{
+				"permissions": r.permissions,
+				"users":       r.users,
+				"channels":    r.channels,
+			} {
+				if list, ok := L.GetField(opt, field).(*lua.LTable); ok {
+					list.ForEach(func(_, v lua.LValue) { set[v.String()] = true })
+				}
+			}
+			roles[role] = r
+		})
+	}
+	acl.SetConfig(roles)
+}
+
+// aclFilter passes messages only from senders who have the given permission
+// in the channel.
+func aclFilter(permission, denied string) respondFilter {
+	return func(client ChatClient, e *MessageEvent) bool {
+		if acl.Check(e.UserId, e.ChannelId, permission) {
+			return true
+		}
+		acl.Deny(e, permission)
+		if len(denied) != 0 {
+			reply(client, e.Target, denied)
+		}
+		return false
+	}
+}
+
+var aclMod = map[string]lua.LGFunction{
+	"grant": func(L *lua.LState) int {
+		acl.Grant(L.CheckString(1), L.CheckString(2))
+		return 0
+	},
+	"revoke": func(L *lua.LState) int {
+		acl.Revoke(L.CheckString(1), L.CheckString(2))
+		return 0
+	},
+	"allow": func(L *lua.LState) int {
+		role := L.CheckString(1)
+		for i := 2; i <= L.GetTop(); i++ {
+			acl.Allow(role, L.CheckString(i))
+		}
+		return 0
+	},
+	"restrict": func(L *lua.LState) int {
+		role := L.CheckString(1)
+		for i := 2; i <= L.GetTop(); i++ {
+			acl.Restrict(role, L.CheckString(i))
+		}
+		return 0
+	},
+	"check": func(L *lua.LState) int {
+		L.Push(lua.LBool(acl.Check(L.CheckString(1), L.OptString(3, ""), L.CheckString(2))))
+		return 1
+	},
+	"roles": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		for _, r := range acl.Roles(L.CheckString(1)) {
+			tbl.Append(lua.LString(r))
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
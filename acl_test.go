@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestAclCheck(t *testing.T) {
+	a := &accessControlList{roles: make(map[string]*aclRole), config: make(map[string]*aclRole)}
+	a.Allow("deployer", "deploy")
+	a.Grant("deployer", "U1")
+	a.Allow("ops", "restart")
+	a.Restrict("ops", "C1")
+	a.Grant("ops", "U2")
+	cases := []struct {
+		user       string
+		channel    string
+		permission string
+		ok         bool
+	}{
+		{"U1", "C1", "deploy", true},
+		{"U1", "C2", "deploy", true},
+		{"U1", "C1", "restart", false},
+		{"U2", "C1", "restart", true},
+		{"U2", "C2", "restart", false},
+		{"U3", "C1", "deploy", false},
+		{"", "C1", "deploy", false},
+	}
+	for _, c := range cases {
+		if ok := a.Check(c.user, c.channel, c.permission); ok != c.ok {
+			t.Errorf("%q %s %s: expected %v, got %v", c.user, c.channel, c.permission, c.ok, ok)
+		}
+	}
+	// users without ids never have roles, even if they were granted by mistake
+	a.Grant("deployer", "")
+	if a.Check("", "C1", "deploy") {
+		t.Errorf("empty user ids must be denied")
+	}
+}
+
+func TestLoadAclOption(t *testing.T) {
+	saved := acl
+	defer func() { acl = saved }()
+	acl = &accessControlList{roles: make(map[string]*aclRole), config: make(map[string]*aclRole)}
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`
+	  before = {deployer = {permissions = {"deploy"}, users = {"U1", "U2"}}}
+	  after = {deployer = {permissions = {"deploy"}, users = {"U1"}}}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	loadAclOption(L, L.GetGlobal("before"))
+	acl.Grant("deployer", "U3")
+	if !acl.Check("U2", "C1", "deploy") || !acl.Check("U3", "C1", "deploy") {
+		t.Fatalf("expected roles of the option and golbot.acl")
+	}
+
+	// reloading replaces roles of the option and keeps golbot.acl changes
+	loadAclOption(L, L.GetGlobal("after"))
+	if acl.Check("U2", "C1", "deploy") {
+		t.Errorf("users removed from the option must lose their roles")
+	}
+	if !acl.Check("U1", "C1", "deploy") || !acl.Check("U3", "C1", "deploy") {
+		t.Errorf("expected remaining users to keep their roles")
+	}
+	loadAclOption(L, lua.LNil)
+	if acl.Check("U1", "C1", "deploy") {
+		t.Errorf("roles of a removed option must be cleared")
+	}
+	if roles := acl.Roles("U3"); !reflect.DeepEqual(roles, []string{"deployer"}) {
+		t.Errorf("unexpected roles: %v", roles)
+	}
+}
+
+func TestHipchatUserJid(t *testing.T) {
+	client := &hipchatChatClient{roomsJids: []string{"1_room@conf.hipchat.com"}}
+	if jid := client.userJid("1_room@conf.hipchat.com", "Admin"); jid != "" {
+		t.Errorf("room senders must not have ids, got %q", jid)
+	}
+	if jid := client.userJid("1_2@chat.hipchat.com", "Alice"); jid != "1_2@chat.hipchat.com" {
+		t.Errorf("expected the sender JID, got %q", jid)
+	}
+}
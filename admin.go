@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// channelLister is implemented by clients that know their channels.
+type channelLister interface {
+	Channels() []string
+}
+
+// botReady returns true if the bot is connected to the chat server.
+func botReady() bool {
+	client := getRunningClient()
+	return client != nil && client.CommonOption().Outbox.Connected()
+}
+
+// serveHealth serves /healthz and /readyz. It returns false for other paths.
+func serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz":
+		w.Write([]byte("ok"))
+	case "/readyz":
+		if !botReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return true
+		}
+		w.Write([]byte("ok"))
+	default:
+		return false
+	}
+	return true
+}
+
+// adminOption configures the admin API.
+type adminOption struct {
+	Path string
+	Auth []*httpAuth
+}
+
+func loadAdminOption(L *lua.LState, tbl *lua.LTable) *adminOption {
+	o := &adminOption{Path: "/admin"}
+	if s, ok := getStringField(L, tbl, "path"); ok {
+		o.Path = "/" + strings.Trim(s, "/")
+	}
+	o.Auth = loadHttpAuths(L, L.GetField(tbl, "auth"))
+	if len(o.Auth) == 0 {
+		L.RaiseError("admin: 'auth' is required")
+	}
+	return o
+}
+
+func (o *adminOption) Match(path string) bool {
+	return path == o.Path || strings.HasPrefix(path, o.Path+"/")
+}
+
+type adminAdapter struct {
+	Type      string `json:"type"`
+	Connected bool   `json:"connected"`
+	Outbox    int    `json:"outbox"`
+}
+
+type adminHandlers struct {
+	On      map[string]int `json:"on"`
+	Respond []string       `json:"respond"`
+}
+
+type adminSayRequest struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+}
+
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+func adminAdapters() []adminAdapter {
+	adapters := []adminAdapter{}
+	if client := getRunningClient(); client != nil {
+		outbox := client.CommonOption().Outbox
+		adapters = append(adapters, adminAdapter{adapterName(client), outbox.Connected(), outbox.Len()})
+	}
+	return adapters
+}
+
+func adminChannels() []string {
+	channels := []string{}
+	if lister, ok := getRunningClient().(channelLister); ok {
+		channels = append(channels, lister.Channels()...)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func adminHandlerList() adminHandlers {
+	handlers := adminHandlers{On: map[string]int{}, Respond: []string{}}
+	if h := getRunningHandlers(); h != nil {
+		handlers.On, handlers.Respond = h.Snapshot()
+	}
+	return handlers
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+var adminMethods = map[string][]string{
+	"": {"GET"}, "adapters": {"GET"}, "channels": {"GET"}, "handlers": {"GET"},
+	"crons": {"GET"}, "jobs": {"GET"}, "reload": {"POST"}, "say": {"POST"},
+	"loglevel": {"GET", "PUT"},
+}
+
+func serveAdmin(w http.ResponseWriter, r *http.Request, o *adminOption, logger *log.Logger) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, o.Path), "/")
+	methods, ok := adminMethods[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	allowed := false
+	for _, method := range methods {
+		allowed = allowed || r.Method == method
+	}
+	if !allowed {
+		methodNotAllowed(w, methods)
+		return
+	}
+	switch name {
+	case "":
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"adapters":  adminAdapters(),
+			"channels":  adminChannels(),
+			"handlers":  adminHandlerList(),
+			"crons":     cronStatuses(),
+			"jobs":      jobs.Stats(),
+			"log_level": getLogLevel().String(),
+		})
+	case "adapters":
+		writeJson(w, http.StatusOK, adminAdapters())
+	case "channels":
+		writeJson(w, http.StatusOK, adminChannels())
+	case "handlers":
+		writeJson(w, http.StatusOK, adminHandlerList())
+	case "crons":
+		writeJson(w, http.StatusOK, cronStatuses())
+	case "jobs":
+		writeJson(w, http.StatusOK, jobs.Stats())
+	case "reload":
+		if err := reloadConfig(); err != nil {
+			logger.Printf("[ERROR] admin: failed to reload: %s", err.Error())
+			writeJsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Printf("[INFO] admin: reloaded")
+		writeJson(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	case "say":
+		req := &adminSayRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeJsonError(w, bodyErrorStatus(err), err)
+			return
+		}
+		if len(req.Channel) == 0 || len(req.Text) == 0 {
+			writeJson(w, http.StatusBadRequest, map[string]string{"error": "'channel' and 'text' are required"})
+			return
+		}
+		status, err := sayMain(req.Channel, req.Text)
+		if err != nil {
+			writeJsonError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJson(w, http.StatusOK, map[string]string{"status": status})
+	case "loglevel":
+		if r.Method == "PUT" {
+			req := &adminLogLevel{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				writeJsonError(w, bodyErrorStatus(err), err)
+				return
+			}
+			level, ok := parseLogLevel(req.Level)
+			if !ok {
+				writeJson(w, http.StatusBadRequest, map[string]string{"error": "unknown log level: " + req.Level})
+				return
+			}
+			setLogLevel(level)
+			logger.Printf("[WARN] admin: log level is %s", level)
+		}
+		writeJson(w, http.StatusOK, &adminLogLevel{getLogLevel().String()})
+	}
+}
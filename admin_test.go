@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestAdminWithoutGlobalMutex(t *testing.T) {
+	saved := getRunningClient()
+	defer setRunningClient(saved)
+	client := &nullChatClient{handlers: newChatHandlers()}
+	client.commonOption = &CommonClientOption{Logger: log.New(ioutil.Discard, "", 0), Outbox: newOutbox()}
+	L := lua.NewState()
+	defer L.Close()
+	fn := L.NewFunction(func(L *lua.LState) int { return 0 })
+	client.handlers.On("join", fn)
+	client.handlers.Respond(regexp.MustCompile("deploy (\\S+)"), fn)
+	setRunningClient(client)
+
+	// long running handlers hold the global mutex
+	mutex.Lock()
+	defer mutex.Unlock()
+	done := make(chan struct{})
+	var adapters []adminAdapter
+	var handlers adminHandlers
+	go func() {
+		adapters = adminAdapters()
+		handlers = adminHandlerList()
+		adminChannels()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("admin endpoints must not wait for the global mutex")
+	}
+	if !reflect.DeepEqual(adapters, []adminAdapter{{"Null", false, 0}}) {
+		t.Errorf("unexpected adapters: %v", adapters)
+	}
+	if !reflect.DeepEqual(handlers, adminHandlers{map[string]int{"join": 1}, []string{"deploy (\\S+)"}}) {
+		t.Errorf("unexpected handlers: %v", handlers)
+	}
+}
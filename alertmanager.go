@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// alertmanagerPayload is a payload of Alertmanager webhook receivers.
+type alertmanagerPayload struct {
+	Receiver          string              `json:"receiver"`
+	Status            string              `json:"status"`
+	Alerts            []alertmanagerAlert `json:"alerts"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	GroupKey          string              `json:"groupKey"`
+}
+
+// Event returns a table passed to templates and format functions.
+func (p *alertmanagerPayload) Event() map[string]interface{} {
+	alerts := []interface{}{}
+	firing := 0
+	for _, a := range p.Alerts {
+		if a.Status == "firing" {
+			firing++
+		}
+		alerts = append(alerts, map[string]interface{}{
+			"status":        a.Status,
+			"labels":        a.Labels,
+			"annotations":   a.Annotations,
+			"starts_at":     a.StartsAt.Unix(),
+			"ends_at":       a.EndsAt.Unix(),
+			"generator_url": a.GeneratorURL,
+			"fingerprint":   a.Fingerprint,
+		})
+	}
+	return map[string]interface{}{
+		"receiver":           p.Receiver,
+		"status":             p.Status,
+		"alerts":             alerts,
+		"firing":             firing,
+		"resolved":           len(p.Alerts) - firing,
+		"title":              labelsString(p.GroupLabels),
+		"group_key":          p.GroupKey,
+		"group_labels":       p.GroupLabels,
+		"common_labels":      p.CommonLabels,
+		"common_annotations": p.CommonAnnotations,
+		"external_url":       p.ExternalURL,
+	}
+}
+
+func labelsString(labels map[string]string) string {
+	pairs := []string{}
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+const alertmanagerTimeout = 10 * time.Second
+
+var alertmanagerFuncs = template.FuncMap{"upper": strings.ToUpper}
+
+var alertmanagerTemplate = template.Must(template.New("alertmanager").Funcs(alertmanagerFuncs).Parse(`[{{upper .status}}{{if eq .status "firing"}}:{{.firing}}{{end}}] {{.title}}{{range .alerts}}
+- {{.labels.alertname}}{{with .annotations.summary}}: {{.}}{{end}}{{if eq .status "resolved"}} (resolved){{end}}{{end}}`))
+
+// alertMessageRetention is how long messages of alert groups are remembered.
+// Groups that are never resolved, e.g. because their alerts were silenced, are
+// forgotten after this.
+const alertMessageRetention = 24 * time.Hour
+
+type alertMessage struct {
+	id      string
+	updated time.Time
+}
+
+// alertNotifications remembers messages posted for firing alert groups, so
+// that they can be edited when the alerts are resolved.
+type alertNotifications struct {
+	sync.Mutex
+	messages map[string]alertMessage
+}
+
+var alertMessages = &alertNotifications{messages: make(map[string]alertMessage)}
+
+func (n *alertNotifications) Get(key string) (string, bool) {
+	n.Lock()
+	defer n.Unlock()
+	m, ok := n.messages[key]
+	return m.id, ok
+}
+
+func (n *alertNotifications) Set(key, id string) {
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	n.prune(now)
+	n.messages[key] = alertMessage{id, now}
+}
+
+func (n *alertNotifications) Delete(key string) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.messages, key)
+}
+
+func (n *alertNotifications) prune(now time.Time) {
+	for key, m := range n.messages {
+		if now.Sub(m.updated) > alertMessageRetention {
+			delete(n.messages, key)
+		}
+	}
+}
+
+// notifyAlerts posts or edits the notification of the alert group. Messages
+// are sent through the outbox if the client can not edit messages or is
+// disconnected.
+func notifyAlerts(channel, groupKey, status, message string) error {
+	client := getRunningClient()
+	if client == nil {
+		return errors.New("bot is not running")
+	}
+	outbox := client.CommonOption().Outbox
+	editor, ok := client.(messageEditor)
+	if !ok || !outbox.Connected() {
+		_, err := outbox.Send(client, channel, message, "")
+		return err
+	}
+	key := channel + "\x00" + groupKey
+	if id, ok := alertMessages.Get(key); ok {
+		if status == "resolved" {
+			alertMessages.Delete(key)
+		}
+		err := editor.UpdateMessage(channel, id, message)
+		if err == nil {
+			if status == "firing" {
+				alertMessages.Set(key, id)
+			}
+			return nil
+		}
+		client.Logger().Printf("[WARN] alertmanager: failed to update a message in %s, posting a new one: %s", channel, err.Error())
+	}
+	id, err := editor.PostMessage(channel, message)
+	if err != nil {
+		client.Logger().Printf("[WARN] alertmanager: failed to post a message to %s: %s", channel, err.Error())
+		_, err = outbox.Send(client, channel, message, "")
+		return err
+	}
+	if status == "firing" {
+		alertMessages.Set(key, id)
+	}
+	return nil
+}
+
+func alertmanagerMessage(L *lua.LState, format lua.LValue, e map[string]interface{}, le lua.LValue) (string, bool, error) {
+	tmpl := alertmanagerTemplate
+	switch f := format.(type) {
+	case *lua.LFunction:
+		pushN(L, f, le)
+		L.Call(1, 1)
+		ret := L.Get(-1)
+		L.Pop(1)
+		if s, ok := ret.(lua.LString); ok {
+			return string(s), true, nil
+		}
+		return "", false, nil
+	case lua.LString:
+		var err error
+		if tmpl, err = template.New("alertmanager").Funcs(alertmanagerFuncs).Parse(string(f)); err != nil {
+			return "", false, err
+		}
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, e); err != nil {
+		return "", false, err
+	}
+	return buf.String(), true, nil
+}
+
+func alertmanagerHandler(L *lua.LState, opt *lua.LTable) *lua.LFunction {
+	channels, ok := L.GetField(opt, "channels").(*lua.LTable)
+	if !ok {
+		channels = L.NewTable()
+	}
+	format := L.GetField(opt, "format")
+	return L.NewFunction(func(L *lua.LState) int {
+		r := L.CheckUserData(1).Value.(*http.Request)
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			pushN(L, lua.LNumber(bodyErrorStatus(err)), L.NewTable(), lua.LString(err.Error()))
+			return 3
+		}
+		payload := &alertmanagerPayload{}
+		if err := json.Unmarshal(body, payload); err != nil {
+			pushN(L, lua.LNumber(http.StatusBadRequest), L.NewTable(), lua.LString(err.Error()))
+			return 3
+		}
+		e := payload.Event()
+		le, err := webhookEventToLua(L, e)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		message, ok, err := alertmanagerMessage(L, format, e, le)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		if ok {
+			for _, channel := range webhookChannels(L, channels, payload.Receiver) {
+				if err := notifyAlerts(channel, payload.GroupKey, payload.Status, message); err != nil {
+					L.RaiseError(err.Error())
+				}
+			}
+		}
+		pushN(L, lua.LNumber(http.StatusOK), L.NewTable(), lua.LString("ok"))
+		return 3
+	})
+}
+
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+type silence struct {
+	Id        string           `json:"id,omitempty"`
+	Matchers  []silenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+var silenceMatcherPattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)(=~|!~|!=|=)(.*)$`)
+
+// parseSilenceMatcher parses matchers like "name=value", "name!=value",
+// "name=~regex" and "name!~regex".
+func parseSilenceMatcher(s string) (silenceMatcher, error) {
+	m := silenceMatcherPattern.FindStringSubmatch(s)
+	if m == nil {
+		return silenceMatcher{}, fmt.Errorf("invalid matcher: %s", s)
+	}
+	return silenceMatcher{
+		Name:    m[1],
+		Value:   strings.Trim(m[3], `"`),
+		IsRegex: strings.HasSuffix(m[2], "~"),
+		IsEqual: strings.HasPrefix(m[2], "="),
+	}, nil
+}
+
+// alertmanagerContext returns a context for Alertmanager API calls bounded by
+// the deadline of L and alertmanagerTimeout.
+func alertmanagerContext(L *lua.LState) (context.Context, context.CancelFunc) {
+	parent := L.Context()
+	if parent == nil {
+		parent = context.Background()
+	}
+	return context.WithTimeout(parent, alertmanagerTimeout)
+}
+
+func alertmanagerCall(ctx context.Context, method, url string, data []byte, v interface{}) error {
+	headers := []string{}
+	if data != nil {
+		headers = append(headers, "Content-Type", "application/json")
+	}
+	res, err := httpRequest(httpRequestParam{Method: method, Url: url, Data: data, Headers: headers, Context: ctx})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("alertmanager: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	if v != nil {
+		return json.Unmarshal(body, v)
+	}
+	return nil
+}
+
+func createSilence(ctx context.Context, url string, s *silence) (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := alertmanagerCall(ctx, "POST", strings.TrimRight(url, "/")+"/api/v2/silences", data, &result); err != nil {
+		return "", err
+	}
+	return result.SilenceID, nil
+}
+
+func expireSilence(ctx context.Context, url, id string) error {
+	return alertmanagerCall(ctx, "DELETE", strings.TrimRight(url, "/")+"/api/v2/silence/"+id, nil, nil)
+}
+
+// activeSilences returns silences that are not expired.
+func activeSilences(ctx context.Context, url string) ([]silence, error) {
+	silences := []silence{}
+	if err := alertmanagerCall(ctx, "GET", strings.TrimRight(url, "/")+"/api/v2/silences", nil, &silences); err != nil {
+		return nil, err
+	}
+	active := []silence{}
+	for _, s := range silences {
+		if s.Status == nil || s.Status.State != "expired" {
+			active = append(active, s)
+		}
+	}
+	return active, nil
+}
+
+func (m silenceMatcher) String() string {
+	op := "="
+	if m.IsRegex {
+		op = "=~"
+	}
+	if !m.IsEqual {
+		op = strings.Replace(op, "=", "!", 1)
+	}
+	return m.Name + op + m.Value
+}
+
+func silenceString(s silence) string {
+	matchers := []string{}
+	for _, m := range s.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	return fmt.Sprintf("%s %s until %s by %s: %s", s.Id, strings.Join(matchers, " "), s.EndsAt.Local().Format("2006-01-02 15:04"), s.CreatedBy, s.Comment)
+}
+
+func parseSilenceDuration(lv lua.LValue) (time.Duration, error) {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		return time.Duration(float64(v) * float64(time.Second)), nil
+	case lua.LString:
+		return time.ParseDuration(string(v))
+	}
+	return 0, errors.New("number or duration string expected")
+}
+
+func newSilence(matchers []silenceMatcher, d time.Duration, createdBy, comment string) *silence {
+	now := time.Now()
+	return &silence{Matchers: matchers, StartsAt: now, EndsAt: now.Add(d), CreatedBy: createdBy, Comment: comment}
+}
+
+type chatCommand struct {
+	pattern string
+	run     func(ctx context.Context, m []string, e *MessageEvent) string
+}
+
+// alertmanagerCommands registers chat commands to manage silences.
+func alertmanagerCommands(L *lua.LState, client ChatClient, url string, filters []respondFilter) {
+	commands := []chatCommand{
+		{`\bsilence (.+?) for (\S+)(?: (.+))?$`, func(ctx context.Context, m []string, e *MessageEvent) string {
+			matchers := []silenceMatcher{}
+			for _, s := range strings.Fields(m[1]) {
+				matcher, err := parseSilenceMatcher(s)
+				if err != nil {
+					return err.Error()
+				}
+				matchers = append(matchers, matcher)
+			}
+			d, err := time.ParseDuration(m[2])
+			if err != nil {
+				return err.Error()
+			}
+			comment := m[3]
+			if len(comment) == 0 {
+				comment = "silenced from chat"
+			}
+			id, err := createSilence(ctx, url, newSilence(matchers, d, e.From, comment))
+			if err != nil {
+				return err.Error()
+			}
+			return "silenced: " + id
+		}},
+		{`\bunsilence (\S+)`, func(ctx context.Context, m []string, e *MessageEvent) string {
+			if err := expireSilence(ctx, url, m[1]); err != nil {
+				return err.Error()
+			}
+			return "expired: " + m[1]
+		}},
+		{`\bsilences$`, func(ctx context.Context, m []string, e *MessageEvent) string {
+			silences, err := activeSilences(ctx, url)
+			if err != nil {
+				return err.Error()
+			}
+			if len(silences) == 0 {
+				return "no silences"
+			}
+			lines := []string{}
+			for _, s := range silences {
+				lines = append(lines, silenceString(s))
+			}
+			return strings.Join(lines, "\n")
+		}},
+	}
+	for _, command := range commands {
+		run, pattern := command.run, command.pattern
+		fs := append(append([]respondFilter{}, filters...), rateLimiter.Filter(pattern))
+		// commands do not ask questions, so they are called without conversations.
+		client.Respond(L, regexp.MustCompile(pattern), L.NewFunction(func(L *lua.LState) int {
+			m := L.CheckUserData(1).Value.([]string)
+			e := L.CheckUserData(2).Value.(*MessageEvent)
+			if !applyFilters(client, e, pattern, fs) {
+				return 0
+			}
+			// Alertmanager may be slow, so commands run without the global mutex.
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), alertmanagerTimeout)
+				defer cancel()
+				reply(client, e.Target, run(ctx, m, e))
+			}()
+			return 0
+		}))
+	}
+}
+
+var alertmanagerMod = map[string]lua.LGFunction{
+	"route": func(L *lua.LState) int {
+		opt := L.CheckTable(2)
+		route := newHttpRoute(L, "POST", L.CheckString(1))
+		route.auth = loadHttpAuths(L, L.GetField(opt, "auth"))
+		chain := L.NewTable()
+		chain.Append(alertmanagerHandler(L, opt))
+		addRoute(L, route, chain)
+		return 0
+	},
+	"commands": func(L *lua.LState) int {
+		client := checkChatClientG(L)
+		opt := L.CheckTable(2)
+		url, ok := getStringField(L, opt, "url")
+		if !ok {
+			L.ArgError(2, "'url' is required")
+		}
+		// silences hide alerts from everyone, so commands are denied unless
+		// users have the permission
+		permission, ok := getStringField(L, opt, "permission")
+		if !ok {
+			permission = "alertmanager"
+		}
+		alertmanagerCommands(L, client, url, []respondFilter{aclFilter(permission, "permission denied")})
+		return 0
+	},
+	"silence": func(L *lua.LState) int {
+		url := L.CheckString(1)
+		matchers := []silenceMatcher{}
+		L.CheckTable(2).ForEach(func(_, v lua.LValue) {
+			matcher, err := parseSilenceMatcher(v.String())
+			if err != nil {
+				L.ArgError(2, err.Error())
+			}
+			matchers = append(matchers, matcher)
+		})
+		d, err := parseSilenceDuration(L.CheckAny(3))
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		opt := L.OptTable(4, L.NewTable())
+		createdBy, ok := getStringField(L, opt, "created_by")
+		if !ok {
+			createdBy = "golbot"
+		}
+		comment, _ := getStringField(L, opt, "comment")
+		ctx, cancel := alertmanagerContext(L)
+		defer cancel()
+		id, err := createSilence(ctx, url, newSilence(matchers, d, createdBy, comment))
+		if err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(id))
+		return 1
+	},
+	"expire": func(L *lua.LState) int {
+		ctx, cancel := alertmanagerContext(L)
+		defer cancel()
+		if err := expireSilence(ctx, L.CheckString(1), L.CheckString(2)); err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	},
+	"silences": func(L *lua.LState) int {
+		ctx, cancel := alertmanagerContext(L)
+		defer cancel()
+		silences, err := activeSilences(ctx, L.CheckString(1))
+		if err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		tbl := L.NewTable()
+		for _, s := range silences {
+			stbl := L.NewTable()
+			stbl.RawSetString("id", lua.LString(s.Id))
+			matchers := L.NewTable()
+			for _, m := range s.Matchers {
+				matchers.Append(lua.LString(m.String()))
+			}
+			stbl.RawSetString("matchers", matchers)
+			stbl.RawSetString("starts_at", lua.LNumber(s.StartsAt.Unix()))
+			stbl.RawSetString("ends_at", lua.LNumber(s.EndsAt.Unix()))
+			stbl.RawSetString("created_by", lua.LString(s.CreatedBy))
+			stbl.RawSetString("comment", lua.LString(s.Comment))
+			if s.Status != nil {
+				stbl.RawSetString("state", lua.LString(s.Status.State))
+			}
+			tbl.Append(stbl)
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// respondChatClient registers respond callbacks so that they can be dispatched.
+type respondChatClient struct {
+	testChatClient
+}
+
+func (client *respondChatClient) Respond(L *lua.LState, pattern *regexp.Regexp, fn *lua.LFunction) {
+	client.handlers.Respond(pattern, fn)
+}
+
+func TestAlertmanagerCommandsPermission(t *testing.T) {
+	saved := acl
+	defer func() { acl = saved }()
+	acl = &accessControlList{roles: make(map[string]*aclRole), config: make(map[string]*aclRole)}
+	client := &respondChatClient{testChatClient{failAfter: -1}}
+	client.handlers = newChatHandlers()
+	client.commonOption = &CommonClientOption{Logger: log.New(ioutil.Discard, "", 0), Outbox: newOutbox()}
+	client.commonOption.Outbox.SetConnected(true)
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("bot", newChatClient(L, nullChatClientTypeName, client, L.NewUserData()))
+	L.SetGlobal("commands", L.NewFunction(alertmanagerMod["commands"]))
+	if err := L.DoString(`commands(bot, {url = "http://127.0.0.1:1"})`); err != nil {
+		t.Fatal(err)
+	}
+	dispatchMessage(L, client, NewMessageEvent("U1", "alice", "C1", "#ops", "golbot silences", nil), regexp.MustCompile("^golbot\\s+"))
+	if !reflect.DeepEqual(client.sent, []string{"#ops:permission denied"}) {
+		t.Errorf("commands must require a permission by default, got %v", client.sent)
+	}
+}
+
+func TestAlertNotificationsPrune(t *testing.T) {
+	n := &alertNotifications{messages: make(map[string]alertMessage)}
+	n.Set("#ops\x00old", "1")
+	n.Set("#ops\x00new", "2")
+	n.messages["#ops\x00old"] = alertMessage{"1", time.Now().Add(-alertMessageRetention - time.Minute)}
+	n.Set("#ops\x00other", "3")
+	if _, ok := n.Get("#ops\x00old"); ok {
+		t.Errorf("old messages must be pruned")
+	}
+	if id, ok := n.Get("#ops\x00new"); !ok || id != "2" {
+		t.Errorf("expected the message to be kept, got %q %v", id, ok)
+	}
+}
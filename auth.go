@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// slackMaxClockSkew is the maximum age of signed Slack requests.
+const slackMaxClockSkew = 5 * time.Minute
+
+// httpAuth verifies http requests before they are passed to Lua.
+type httpAuth struct {
+	// "bearer", "basic", "github", "gitlab", "slack" or "hmac"
+	Type   string
+	Tokens []string
+	Users  map[string]string
+	Secret string
+	// options for "hmac"
+	Header   string
+	Prefix   string
+	Hash     func() hash.Hash
+	Encoding string
+}
+
+func (a *httpAuth) NeedsBody() bool {
+	switch a.Type {
+	case "github", "slack", "hmac":
+		return true
+	}
+	return false
+}
+
+func (a *httpAuth) Verify(r *http.Request, body []byte) bool {
+	switch a.Type {
+	case "bearer":
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") {
+			return false
+		}
+		return a.matchToken(strings.TrimPrefix(h, "Bearer "))
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return false
+		}
+		expected, ok := a.Users[user]
+		return ok && secureCompare(password, expected)
+	case "gitlab":
+		return a.matchToken(r.Header.Get("X-Gitlab-Token"))
+	case "github":
+		return verifySignature(sha256.New, a.Secret, body, r.Header.Get("X-Hub-Signature-256"), "sha256=", "hex")
+	case "slack":
+		ts := r.Header.Get("X-Slack-Request-Timestamp")
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || math.Abs(time.Since(time.Unix(n, 0)).Seconds()) > slackMaxClockSkew.Seconds() {
+			return false
+		}
+		base := append([]byte("v0:"+ts+":"), body...)
+		return verifySignature(sha256.New, a.Secret, base, r.Header.Get("X-Slack-Signature"), "v0=", "hex")
+	case "hmac":
+		return verifySignature(a.Hash, a.Secret, body, r.Header.Get(a.Header), a.Prefix, a.Encoding)
+	}
+	return false
+}
+
+func (a *httpAuth) matchToken(token string) bool {
+	for _, t := range a.Tokens {
+		if secureCompare(token, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func secureCompare(a, b string) bool {
+	return len(a) != 0 && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func verifySignature(h func() hash.Hash, secret string, message []byte, signature, prefix, encoding string) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(message)
+	var expected string
+	if encoding == "base64" {
+		expected = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		expected = hex.EncodeToString(mac.Sum(nil))
+	}
+	return secureCompare(strings.TrimPrefix(signature, prefix), expected)
+}
+
+// authorize verifies the request. A request is accepted if one of auths
+// accepts it. The body is read and restored if signatures are verified.
+func authorize(w http.ResponseWriter, r *http.Request, auths []*httpAuth) bool {
+	if len(auths) == 0 {
+		return true
+	}
+	var body []byte
+	for _, a := range auths {
+		if a.NeedsBody() && body == nil {
+			b, err := readRequestBody(r)
+			if err != nil {
+				status := bodyErrorStatus(err)
+				http.Error(w, http.StatusText(status), status)
+				return false
+			}
+			body = b
+		}
+		if a.Verify(r, body) {
+			return true
+		}
+	}
+	for _, a := range auths {
+		if a.Type == "basic" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="golbot"`)
+		}
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+var hmacHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func loadHttpAuth(L *lua.LState, tbl *lua.LTable) *httpAuth {
+	a := &httpAuth{Users: map[string]string{}}
+	a.Type, _ = getStringField(L, tbl, "type")
+	secret, hasSecret := getStringField(L, tbl, "secret")
+	a.Secret = secret
+	switch a.Type {
+	case "bearer", "gitlab":
+		switch v := L.GetField(tbl, "token").(type) {
+		case lua.LString:
+			a.Tokens = append(a.Tokens, string(v))
+		case *lua.LTable:
+			v.ForEach(func(_, token lua.LValue) { a.Tokens = append(a.Tokens, token.String()) })
+		}
+		if len(a.Tokens) == 0 {
+			L.RaiseError("auth: '%s' requires 'token'", a.Type)
+		}
+	case "basic":
+		if users, ok := L.GetField(tbl, "users").(*lua.LTable); ok {
+			users.ForEach(func(k, v lua.LValue) { a.Users[k.String()] = v.String() })
+		}
+		if len(a.Users) == 0 {
+			L.RaiseError("auth: 'basic' requires 'users'")
+		}
+	case "github", "slack":
+		if !hasSecret {
+			L.RaiseError("auth: '%s' requires 'secret'", a.Type)
+		}
+	case "hmac":
+		var ok bool
+		if a.Header, ok = getStringField(L, tbl, "header"); !ok || !hasSecret {
+			L.RaiseError("auth: 'hmac' requires 'header' and 'secret'")
+		}
+		a.Prefix, _ = getStringField(L, tbl, "prefix")
+		name := "sha256"
+		if s, ok := getStringField(L, tbl, "hash"); ok {
+			name = s
+		}
+		if a.Hash, ok = hmacHashes[name]; !ok {
+			L.RaiseError("auth: unknown hash: %s", name)
+		}
+		a.Encoding = "hex"
+		if s, ok := getStringField(L, tbl, "encoding"); ok {
+			if s != "hex" && s != "base64" {
+				L.RaiseError("auth: 'encoding' must be 'hex' or 'base64'")
+			}
+			a.Encoding = s
+		}
+	default:
+		L.RaiseError("auth: unknown type: %s", a.Type)
+	}
+	return a
+}
+
+// loadHttpAuths loads an auth table or a list of auth tables. It returns nil
+// if no auth is given and an empty list if auth is false.
+func loadHttpAuths(L *lua.LState, lv lua.LValue) []*httpAuth {
+	if lv == lua.LFalse {
+		return []*httpAuth{}
+	}
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	if _, ok := tbl.RawGetString("type").(lua.LString); ok {
+		return []*httpAuth{loadHttpAuth(L, tbl)}
+	}
+	auths := []*httpAuth{}
+	tbl.ForEach(func(_, v lua.LValue) {
+		if t, ok := v.(*lua.LTable); ok {
+			auths = append(auths, loadHttpAuth(L, t))
+		}
+	})
+	return auths
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func testSignature(h func() hash.Hash, secret string, message []byte) []byte {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func TestHttpAuthVerify(t *testing.T) {
+	body := []byte(`{"ok":true}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	github := "sha256=" + hex.EncodeToString(testSignature(sha256.New, "secret", body))
+	slack := func(ts string) string {
+		return "v0=" + hex.EncodeToString(testSignature(sha256.New, "secret", append([]byte("v0:"+ts+":"), body...)))
+	}
+	hmacAuth := &httpAuth{Type: "hmac", Secret: "secret", Header: "X-Signature", Prefix: "sha1=", Hash: sha1.New, Encoding: "base64"}
+	cases := []struct {
+		name    string
+		auth    *httpAuth
+		headers map[string]string
+		ok      bool
+	}{
+		{"bearer", &httpAuth{Type: "bearer", Tokens: []string{"a", "b"}}, map[string]string{"Authorization": "Bearer b"}, true},
+		{"bearer wrong token", &httpAuth{Type: "bearer", Tokens: []string{"a"}}, map[string]string{"Authorization": "Bearer b"}, false},
+		{"bearer no header", &httpAuth{Type: "bearer", Tokens: []string{"a"}}, nil, false},
+		{"bearer empty token", &httpAuth{Type: "bearer", Tokens: []string{""}}, map[string]string{"Authorization": "Bearer "}, false},
+		{"gitlab", &httpAuth{Type: "gitlab", Tokens: []string{"a"}}, map[string]string{"X-Gitlab-Token": "a"}, true},
+		{"github", &httpAuth{Type: "github", Secret: "secret"}, map[string]string{"X-Hub-Signature-256": github}, true},
+		{"github wrong secret", &httpAuth{Type: "github", Secret: "other"}, map[string]string{"X-Hub-Signature-256": github}, false},
+		{"github no prefix", &httpAuth{Type: "github", Secret: "secret"}, map[string]string{"X-Hub-Signature-256": github[7:]}, false},
+		{"slack", &httpAuth{Type: "slack", Secret: "secret"}, map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": slack(now)}, true},
+		{"slack old request", &httpAuth{Type: "slack", Secret: "secret"}, map[string]string{"X-Slack-Request-Timestamp": old, "X-Slack-Signature": slack(old)}, false},
+		{"slack other timestamp", &httpAuth{Type: "slack", Secret: "secret"}, map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": slack(old)}, false},
+		{"hmac", hmacAuth, map[string]string{"X-Signature": "sha1=" + base64.StdEncoding.EncodeToString(testSignature(sha1.New, "secret", body))}, true},
+		{"hmac hex", hmacAuth, map[string]string{"X-Signature": "sha1=" + hex.EncodeToString(testSignature(sha1.New, "secret", body))}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		if ok := c.auth.Verify(r, body); ok != c.ok {
+			t.Errorf("%s: expected %v, got %v", c.name, c.ok, ok)
+		}
+	}
+}
+
+func TestHttpAuthBasic(t *testing.T) {
+	auth := &httpAuth{Type: "basic", Users: map[string]string{"alice": "password"}}
+	cases := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"alice", "password", true},
+		{"alice", "wrong", false},
+		{"bob", "password", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(c.user, c.password)
+		if ok := auth.Verify(r, nil); ok != c.ok {
+			t.Errorf("%s:%s: expected %v, got %v", c.user, c.password, c.ok, ok)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	body := []byte("payload")
+	github := "sha256=" + hex.EncodeToString(testSignature(sha256.New, "secret", body))
+	auths := []*httpAuth{
+		{Type: "basic", Users: map[string]string{"alice": "password"}},
+		{Type: "github", Secret: "secret"},
+	}
+
+	// the body is readable after the signature is verified
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set("X-Hub-Signature-256", github)
+	w := httptest.NewRecorder()
+	if !authorize(w, r, auths) {
+		t.Fatalf("expected the request to be authorized, got %d", w.Code)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); !bytes.Equal(b, body) {
+		t.Errorf("expected the body to be restored, got %q", b)
+	}
+
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	if authorize(w, r, auths) {
+		t.Fatalf("expected the request to be rejected")
+	}
+	if w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0 {
+		t.Errorf("expected 401 with WWW-Authenticate, got %d %v", w.Code, w.Header())
+	}
+
+	// an empty list means no auth
+	r = httptest.NewRequest("GET", "/", nil)
+	if !authorize(httptest.NewRecorder(), r, []*httpAuth{}) {
+		t.Errorf("expected the request to be authorized without auth")
+	}
+}
+
+func TestLoadHttpAuths(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`
+	  single = {type = "bearer", token = "a"}
+	  list = {{type = "bearer", token = {"a", "b"}}, {type = "github", secret = "s"}}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if auths := loadHttpAuths(L, lua.LNil); auths != nil {
+		t.Errorf("expected nil, got %v", auths)
+	}
+	if auths := loadHttpAuths(L, lua.LFalse); auths == nil || len(auths) != 0 {
+		t.Errorf("expected an empty list, got %v", auths)
+	}
+	if auths := loadHttpAuths(L, L.GetGlobal("single")); len(auths) != 1 || auths[0].Tokens[0] != "a" {
+		t.Errorf("unexpected auths: %v", auths)
+	}
+	if auths := loadHttpAuths(L, L.GetGlobal("list")); len(auths) != 2 || len(auths[0].Tokens) != 2 || auths[1].Type != "github" {
+		t.Errorf("unexpected auths: %v", auths)
+	}
+}
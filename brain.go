@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+var brainBucket = []byte("brain")
+
+// brainStore is a key-value store shared by all Lua states.
+// Values are stored as JSON with an expiration time.
+type brainStore struct {
+	sync.RWMutex
+	db *bolt.DB
+	// closed to stop the sweeper
+	stop chan struct{}
+}
+
+var brain = &brainStore{}
+
+var errBrainNotConfigured = errors.New("brain is not configured. use the 'brain' option of golbot.newbot")
+
+func (b *brainStore) Open(path string, logger *log.Logger) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.db != nil {
+		return nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(brainBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return err
+	}
+	b.db = db
+	b.stop = make(chan struct{})
+	go b.sweeper(b.stop, logger)
+	return nil
+}
+
+func (b *brainStore) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.db == nil {
+		return nil
+	}
+	close(b.stop)
+	err := b.db.Close()
+	b.db = nil
+	return err
+}
+
+// sweeper removes expired values every minute until stop is closed.
+func (b *brainStore) sweeper(stop chan struct{}, logger *log.Logger) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.sweep(); err != nil && err != errBrainNotConfigured {
+				logger.Printf("[ERROR] brain: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (b *brainStore) update(fn func(*bolt.Bucket) error) error {
+	b.RLock()
+	defer b.RUnlock()
+	if b.db == nil {
+		return errBrainNotConfigured
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(brainBucket))
+	})
+}
+
+func (b *brainStore) view(fn func(*bolt.Bucket) error) error {
+	b.RLock()
+	defer b.RUnlock()
+	if b.db == nil {
+		return errBrainNotConfigured
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(brainBucket))
+	})
+}
+
+func encodeBrainValue(value []byte, ttl time.Duration) []byte {
+	buf := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(buf, uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(buf[8:], value)
+	return buf
+}
+
+// decodeBrainValue returns nil if the value does not exist or has expired.
+func decodeBrainValue(data []byte, now time.Time) []byte {
+	if len(data) < 8 {
+		return nil
+	}
+	expires := int64(binary.BigEndian.Uint64(data))
+	if expires != 0 && expires <= now.UnixNano() {
+		return nil
+	}
+	return data[8:]
+}
+
+func (b *brainStore) sweep() error {
+	now := time.Now()
+	return b.update(func(bucket *bolt.Bucket) error {
+		// deleting with the cursor while iterating skips entries
+		expired := [][]byte{}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if decodeBrainValue(v, now) == nil {
+				expired = append(expired, append([]byte{}, k...))
+			}
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *brainStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := b.view(func(bucket *bolt.Bucket) error {
+		if v := decodeBrainValue(bucket.Get([]byte(key)), time.Now()); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b *brainStore) Set(key string, value []byte, ttl time.Duration) error {
+	return b.update(func(bucket *bolt.Bucket) error {
+		return bucket.Put([]byte(key), encodeBrainValue(value, ttl))
+	})
+}
+
+func (b *brainStore) Delete(key string) error {
+	return b.update(func(bucket *bolt.Bucket) error {
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// CompareAndSet sets the value only if the current value equals to old.
+// nil old means that the key must not exist, nil value deletes the key.
+func (b *brainStore) CompareAndSet(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	swapped := false
+	err := b.update(func(bucket *bolt.Bucket) error {
+		current := decodeBrainValue(bucket.Get([]byte(key)), time.Now())
+		if (old == nil) != (current == nil) || !bytes.Equal(old, current) {
+			return nil
+		}
+		swapped = true
+		if value == nil {
+			return bucket.Delete([]byte(key))
+		}
+		return bucket.Put([]byte(key), encodeBrainValue(value, ttl))
+	})
+	return swapped, err
+}
+
+// Update replaces the value with the result of fn atomically.
+func (b *brainStore) Update(key string, ttl time.Duration, fn func([]byte) ([]byte, error)) error {
+	return b.update(func(bucket *bolt.Bucket) error {
+		value, err := fn(decodeBrainValue(bucket.Get([]byte(key)), time.Now()))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), encodeBrainValue(value, ttl))
+	})
+}
+
+func (b *brainStore) Scan(prefix string, fn func(key string, value []byte)) error {
+	now := time.Now()
+	return b.view(func(bucket *bolt.Bucket) error {
+		c := bucket.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if value := decodeBrainValue(v, now); value != nil {
+				fn(string(k), value)
+			}
+		}
+		return nil
+	})
+}
+
+func brainTTL(L *lua.LState, n int) time.Duration {
+	return time.Duration(float64(L.OptNumber(n, 0)) * float64(time.Second))
+}
+
+func brainEncode(L *lua.LState, n int) []byte {
+	lv := L.Get(n)
+	if lv == lua.LNil {
+		return nil
+	}
+	b, err := luajson.Encode(lv)
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return b
+}
+
+func brainDecode(L *lua.LState, b []byte) lua.LValue {
+	if b == nil {
+		return lua.LNil
+	}
+	lv, err := luajson.Decode(L, b)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	return lv
+}
+
+func brainRaiseIfError(L *lua.LState, err error) {
+	if err != nil {
+		L.RaiseError("brain: %s", err.Error())
+	}
+}
+
+var brainMod = map[string]lua.LGFunction{
+	"get": func(L *lua.LState) int {
+		value, err := brain.Get(L.CheckString(1))
+		brainRaiseIfError(L, err)
+		L.Push(brainDecode(L, value))
+		return 1
+	},
+	"set": func(L *lua.LState) int {
+		key := L.CheckString(1)
+		value := brainEncode(L, 2)
+		if value == nil {
+			brainRaiseIfError(L, brain.Delete(key))
+			return 0
+		}
+		brainRaiseIfError(L, brain.Set(key, value, brainTTL(L, 3)))
+		return 0
+	},
+	"delete": func(L *lua.LState) int {
+		brainRaiseIfError(L, brain.Delete(L.CheckString(1)))
+		return 0
+	},
+	"incr": func(L *lua.LState) int {
+		key := L.CheckString(1)
+		delta := float64(L.OptNumber(2, 1))
+		var result float64
+		err := brain.Update(key, brainTTL(L, 3), func(value []byte) ([]byte, error) {
+			if value != nil {
+				n, ok := brainDecode(L, value).(lua.LNumber)
+				if !ok {
+					return nil, errors.New("value of '" + key + "' is not a number")
+				}
+				result = float64(n)
+			}
+			result += delta
+			return luajson.Encode(lua.LNumber(result))
+		})
+		brainRaiseIfError(L, err)
+		L.Push(lua.LNumber(result))
+		return 1
+	},
+	"cas": func(L *lua.LState) int {
+		key := L.CheckString(1)
+		swapped, err := brain.CompareAndSet(key, brainEncode(L, 2), brainEncode(L, 3), brainTTL(L, 4))
+		brainRaiseIfError(L, err)
+		L.Push(lua.LBool(swapped))
+		return 1
+	},
+	"scan": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		err := brain.Scan(L.OptString(1, ""), func(key string, value []byte) {
+			tbl.RawSetString(key, brainDecode(L, value))
+		})
+		brainRaiseIfError(L, err)
+		L.Push(tbl)
+		return 1
+	},
+}
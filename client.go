@@ -1,35 +1,167 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"regexp"
+	"sync"
 
 	"github.com/yuin/gopher-lua"
+	"layeh.com/gopher-luar"
 )
 
 type ChatClient interface {
 	Logger() *log.Logger
 	CommonOption() *CommonClientOption
-	Say(target, message string)
+	Raw() interface{}
+	Handlers() *chatHandlers
+	SetHandlers(handlers *chatHandlers)
+	Say(target, message string) error
 	On(L *lua.LState, action string, fn *lua.LFunction)
 	Respond(L *lua.LState, pattern *regexp.Regexp, fn *lua.LFunction)
 	Serve(L *lua.LState, fn *lua.LFunction)
 }
 
+// messageEditor is implemented by clients that can edit sent messages.
+type messageEditor interface {
+	// PostMessage sends a message and returns its id.
+	PostMessage(target, message string) (string, error)
+	UpdateMessage(target, id, message string) error
+}
+
+// threadReplier is implemented by clients that can reply in threads.
+type threadReplier interface {
+	ReplyInThread(target, thread, message string) error
+}
+
+type responder struct {
+	pattern *regexp.Regexp
+	fn      *lua.LFunction
+}
+
+// chatHandlers holds callbacks registered by scripts. Handlers are replaced
+// as a whole when the config file is reloaded.
+type chatHandlers struct {
+	// guards handlers from the admin API, Apply and dispatchMessage read them
+	// with the global mutex held
+	sync.RWMutex
+	callbacks  map[string][]*lua.LFunction
+	responders []responder
+}
+
+func newChatHandlers() *chatHandlers {
+	return &chatHandlers{
+		callbacks:  make(map[string][]*lua.LFunction),
+		responders: []responder{},
+	}
+}
+
+func (h *chatHandlers) On(typ string, fn *lua.LFunction) {
+	h.Lock()
+	defer h.Unlock()
+	h.callbacks[typ] = append(h.callbacks[typ], fn)
+}
+
+func (h *chatHandlers) Respond(pattern *regexp.Regexp, fn *lua.LFunction) {
+	h.Lock()
+	defer h.Unlock()
+	h.responders = append(h.responders, responder{pattern, fn})
+}
+
+// Snapshot returns the number of callbacks per event type and respond patterns.
+func (h *chatHandlers) Snapshot() (map[string]int, []string) {
+	h.RLock()
+	defer h.RUnlock()
+	callbacks := make(map[string]int, len(h.callbacks))
+	for typ, fns := range h.callbacks {
+		callbacks[typ] = len(fns)
+	}
+	patterns := make([]string, 0, len(h.responders))
+	for _, r := range h.responders {
+		patterns = append(patterns, r.pattern.String())
+	}
+	return callbacks, patterns
+}
+
+// Apply calls callbacks for the event type. The global mutex must be held by the caller.
+func (h *chatHandlers) Apply(L *lua.LState, logger *log.Logger, typ string, event interface{}) {
+	for _, callback := range h.callbacks[typ] {
+		pushN(L, callback, luar.New(L, event))
+		if err := pcallWithTimeout(L, "on", 1, 0); err != nil {
+			logger.Printf("[ERROR] %s", err.Error())
+		}
+	}
+}
+
+// luaMain holds the Lua state and the serve function of the main goroutine.
+// They are replaced when the config file is reloaded.
+// The global mutex must be held to access them.
+var luaMain struct {
+	L     *lua.LState
+	serve *lua.LFunction
+}
+
+// callServe passes a message from other goroutines to the serve function.
+// Errors are passed back to the requester if the message is a request.
+func callServe(msg lua.LValue) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	logger := mainClient.chatClient.Logger()
+	pushN(luaMain.L, luaMain.serve, msg)
+	err := pcallWithTimeout(luaMain.L, "serve", 1, 0)
+	if err != nil {
+		logger.Printf("[ERROR] serve: %s", err.Error())
+	}
+	req, ok := toMainRequest(msg)
+	if !ok {
+		return
+	}
+	if err != nil {
+		req.Respond(lua.LNil, err)
+	} else if !req.Responded() {
+		logger.Printf("[WARN] serve: a request was not responded")
+	}
+}
+
+// sayMain sends a message through the running client from other goroutines.
+func sayMain(target, message string) (string, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if mainClient == nil {
+		return "", errors.New("bot is not running")
+	}
+	client := mainClient.chatClient
+	return client.CommonOption().Outbox.Send(client, target, message, "")
+}
+
+// reply sends a message generated by golbot, such as an error message, through
+// the outbox.
+func reply(client ChatClient, target, message string) {
+	if _, err := client.CommonOption().Outbox.Send(client, target, message, ""); err != nil {
+		client.Logger().Printf("[WARN] failed to send a message to %s: %s", target, err.Error())
+	}
+}
+
+// respondFilter decides whether a respond callback should be called for the message.
+type respondFilter func(client ChatClient, e *MessageEvent) bool
+
 type luaChatClient struct {
+	typeName   string
 	underlying *lua.LUserData
 	chatClient ChatClient
 }
 
 type MessageEvent struct {
-	From    string
-	Target  string
-	Message string
-	Raw     interface{}
+	UserId    string
+	From      string
+	ChannelId string
+	Target    string
+	Message   string
+	Raw       interface{}
 }
 
-func NewMessageEvent(from, target, message string, raw interface{}) *MessageEvent {
-	return &MessageEvent{from, target, message, raw}
+func NewMessageEvent(userId, from, channelId, target, message string, raw interface{}) *MessageEvent {
+	return &MessageEvent{userId, from, channelId, target, message, raw}
 }
 
 func registerChatClientType(L *lua.LState, typeName string) {
@@ -48,7 +180,7 @@ func registerChatClientType(L *lua.LState, typeName string) {
 
 func newChatClient(L *lua.LState, typeName string, chatClient ChatClient, underlyingObject *lua.LUserData) *lua.LUserData {
 	ud := L.NewUserData()
-	ud.Value = &luaChatClient{underlyingObject, chatClient}
+	ud.Value = &luaChatClient{typeName, underlyingObject, chatClient}
 	L.SetMetatable(ud, L.GetTypeMetatable(typeName))
 	return ud
 }
@@ -74,12 +206,21 @@ var chatClientMethods = map[string]lua.LGFunction{
 	"say":     chatClientSay,
 	"on":      chatClientOn,
 	"respond": chatClientRespond,
+	"ask":     chatClientAsk,
 	"serve":   chatClientServe,
 }
 
 func chatClientSay(L *lua.LState) int {
-	checkChatClientG(L).Say(L.CheckString(2), L.CheckString(3))
-	return 0
+	client := checkChatClientG(L)
+	opt := L.OptTable(4, L.NewTable())
+	callback, _ := getStringField(L, opt, "callback")
+	status, err := client.CommonOption().Outbox.Send(client, L.CheckString(2), L.CheckString(3), callback)
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(status))
+	return 1
 }
 
 func chatClientOn(L *lua.LState) int {
@@ -87,17 +228,105 @@ func chatClientOn(L *lua.LState) int {
 	return 0
 }
 
+// applyFilters returns true if the message passes all filters, and publishes
+// a command live event in that case.
+func applyFilters(client ChatClient, e *MessageEvent, pattern string, filters []respondFilter) bool {
+	for _, filter := range filters {
+		if !filter(client, e) {
+			return false
+		}
+	}
+	le := newMessageLiveEvent("command", e)
+	le.Command = pattern
+	liveEvents.Publish(le)
+	return true
+}
+
+func filterRespond(L *lua.LState, client ChatClient, pattern string, fn *lua.LFunction, filters ...respondFilter) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		e, ok := L.CheckUserData(2).Value.(*MessageEvent)
+		if !ok {
+			L.ArgError(2, "MessageEvent expected")
+		}
+		if !applyFilters(client, e, pattern, filters) {
+			return 0
+		}
+		if err := conversations.Start(L, client, fn, L.Get(1), L.Get(2)); err != nil {
+			replyTimeout(client, e.Target, err)
+			L.RaiseError(err.Error())
+		}
+		return 0
+	})
+}
+
+// dispatchMessage passes a message to a conversation waiting for it or to the
+// respond callbacks if the message mentions the bot.
+// The global mutex must be held by the caller.
+func dispatchMessage(L *lua.LState, client ChatClient, e *MessageEvent, mention *regexp.Regexp) {
+	liveEvents.Publish(newMessageLiveEvent("message", e))
+	metricMessagesReceived.Add(1, adapterName(client), e.Target)
+	if conversations.Answer(client, e, mention) || !mention.MatchString(e.Message) {
+		return
+	}
+	for _, r := range client.Handlers().responders {
+		matches := r.pattern.FindAllStringSubmatch(e.Message, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		pushN(L, r.fn, luar.New(L, matches[0]), luar.New(L, e))
+		if err := L.PCall(2, 0, nil); err != nil {
+			client.Logger().Printf("[ERROR] %s", err.Error())
+		}
+	}
+}
+
 func chatClientRespond(L *lua.LState) int {
-	re := regexp.MustCompile(L.CheckString(2))
-	checkChatClientG(L).Respond(L, re, L.CheckFunction(3))
+	client := checkChatClientG(L)
+	pattern := L.CheckString(2)
+	re := regexp.MustCompile(pattern)
+	fn := L.CheckFunction(3)
+	opt := L.OptTable(4, L.NewTable())
+	name := pattern
+	if s, ok := getStringField(L, opt, "name"); ok {
+		name = s
+	}
+	// denied users do not consume tokens
+	filters := []respondFilter{}
+	if permission, ok := getStringField(L, opt, "permission"); ok {
+		denied := "permission denied"
+		if s, ok := getStringField(L, opt, "denied"); ok {
+			denied = s
+		}
+		filters = append(filters, aclFilter(permission, denied))
+	}
+	filters = append(filters, rateLimiter.Filter(name))
+	client.Respond(L, re, filterRespond(L, client, pattern, fn, filters...))
 	return 0
 }
 
 func chatClientServe(L *lua.LState) int {
-	client := checkChatClientG(L)
+	lclient := checkChatClient(L)
+	client := lclient.chatClient
+	fn := L.CheckFunction(2)
+	if reloading {
+		reloadedServe = fn
+		return 0
+	}
+	mutex.Lock()
+	luaMain.L = L
+	luaMain.serve = fn
+	mainClient = lclient
+	mutex.Unlock()
+	setRunningClient(client)
 	startLog(client.CommonOption())
 	startHttpServer(client.CommonOption())
 	startCrons(client.CommonOption())
-	client.Serve(L, L.CheckFunction(2))
+	luaPool.Start()
+	scheduler.Start()
+	startConfigWatcher(client.CommonOption())
+	handleSignals(client.CommonOption())
+	handleLogLevelSignals(client.CommonOption())
+	client.Serve(L, fn)
+	cleanup(client.CommonOption())
 	return 0
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/yuin/gopher-lua"
+)
+
+type conversationKey struct {
+	user    string
+	channel string
+	// Slack thread timestamp
+	thread string
+}
+
+func newConversationKey(e *MessageEvent) conversationKey {
+	key := conversationKey{user: e.UserId, channel: e.ChannelId}
+	if len(key.user) == 0 {
+		key.user = e.From
+	}
+	if m, ok := e.Raw.(*slack.MessageEvent); ok {
+		key.thread = m.ThreadTimestamp
+	}
+	return key
+}
+
+type conversation struct {
+	L       *lua.LState
+	thread  *lua.LState
+	client  ChatClient
+	choices []string
+	target  string
+	timer   *time.Timer
+}
+
+// conversationManager runs respond callbacks as coroutines so that they can
+// wait for answers from users with bot:ask.
+// Conversations are kept per (user, channel, Slack thread).
+type conversationManager struct {
+	sync.Mutex
+	threads map[*lua.LState]*lua.LState
+	pending map[conversationKey]*conversation
+}
+
+var conversations = &conversationManager{
+	threads: make(map[*lua.LState]*lua.LState),
+	pending: make(map[conversationKey]*conversation),
+}
+
+// Start calls fn in a new coroutine. The global mutex must be held by the caller.
+func (cm *conversationManager) Start(L *lua.LState, client ChatClient, fn *lua.LFunction, args ...lua.LValue) error {
+	th, _ := L.NewThread()
+	cm.Lock()
+	cm.threads[th] = L
+	cm.Unlock()
+	return cm.resume(L, client, th, fn, args...)
+}
+
+func (cm *conversationManager) resume(L *lua.LState, client ChatClient, th *lua.LState, fn *lua.LFunction, args ...lua.LValue) error {
+	var state lua.ResumeState
+	err := withTimeout(th, "respond", func() error {
+		var err error
+		state, err, _ = L.Resume(th, fn, args...)
+		return err
+	})
+	cm.Lock()
+	defer cm.Unlock()
+	if state == lua.ResumeYield {
+		for _, c := range cm.pending {
+			if c.thread == th {
+				return nil
+			}
+		}
+		client.Logger().Printf("[WARN] a respond callback yielded without bot:ask, abandoned")
+	}
+	delete(cm.threads, th)
+	databases.Rollback(th, false)
+	return err
+}
+
+// Uses returns true if conversations started in the Lua state are running.
+func (cm *conversationManager) Uses(L *lua.LState) bool {
+	cm.Lock()
+	defer cm.Unlock()
+	for _, parent := range cm.threads {
+		if parent == L {
+			return true
+		}
+	}
+	return false
+}
+
+func (cm *conversationManager) finish(key conversationKey, c *conversation, values ...lua.LValue) {
+	cm.Lock()
+	if cm.pending[key] != c {
+		cm.Unlock()
+		return
+	}
+	delete(cm.pending, key)
+	cm.Unlock()
+	c.timer.Stop()
+	if err := cm.resume(c.L, c.client, c.thread, nil, values...); err != nil {
+		replyTimeout(c.client, c.target, err)
+		c.client.Logger().Printf("[ERROR] %s", err.Error())
+	}
+	closeRetiredStates()
+}
+
+// Answer passes the message to the conversation waiting for it.
+// It returns false if nobody waits for the message. The global mutex must be
+// held by the caller.
+func (cm *conversationManager) Answer(client ChatClient, e *MessageEvent, mention *regexp.Regexp) bool {
+	key := newConversationKey(e)
+	cm.Lock()
+	c, ok := cm.pending[key]
+	cm.Unlock()
+	if !ok {
+		return false
+	}
+	answer := strings.TrimSpace(mention.ReplaceAllString(e.Message, ""))
+	if len(c.choices) != 0 {
+		found := false
+		for _, choice := range c.choices {
+			if strings.EqualFold(choice, answer) {
+				answer = choice
+				found = true
+				break
+			}
+		}
+		if !found {
+			replyInThread(client, key, e.Target, "Please answer "+strings.Join(c.choices, "/"))
+			return true
+		}
+	}
+	cm.finish(key, c, lua.LString(answer), lua.LNil)
+	return true
+}
+
+func (cm *conversationManager) Ask(L *lua.LState, client ChatClient, e *MessageEvent, question string, choices []string, timeout time.Duration) {
+	cm.Lock()
+	defer cm.Unlock()
+	parent, ok := cm.threads[L]
+	if !ok {
+		L.RaiseError("bot:ask can be called only in respond callbacks")
+	}
+	key := newConversationKey(e)
+	if _, ok := cm.pending[key]; ok {
+		L.RaiseError("%s is already answering another question in %s", e.From, e.Target)
+	}
+	if len(choices) != 0 {
+		question = question + " (" + strings.Join(choices, "/") + ")"
+	}
+	c := &conversation{parent, L, client, choices, e.Target, nil}
+	c.timer = time.AfterFunc(timeout, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cm.finish(key, c, lua.LNil, lua.LString("timeout"))
+	})
+	cm.pending[key] = c
+	replyInThread(client, key, e.Target, question)
+}
+
+// replyInThread sends the message to the thread of the conversation so that
+// answers in the thread match the key.
+func replyInThread(client ChatClient, key conversationKey, target, message string) {
+	tr, ok := client.(threadReplier)
+	if !ok || len(key.thread) == 0 {
+		reply(client, target, message)
+		return
+	}
+	if err := tr.ReplyInThread(target, key.thread, message); err != nil {
+		client.Logger().Printf("[WARN] failed to send a message to %s: %s", target, err.Error())
+	}
+}
+
+func chatClientAsk(L *lua.LState) int {
+	client := checkChatClientG(L)
+	e, ok := L.CheckUserData(2).Value.(*MessageEvent)
+	if !ok {
+		L.ArgError(2, "MessageEvent expected")
+	}
+	question := L.CheckString(3)
+	opt := L.OptTable(4, L.NewTable())
+	timeout := 60 * time.Second
+	if n, ok := getNumberField(L, opt, "timeout"); ok {
+		timeout = time.Duration(n * float64(time.Second))
+	}
+	choices := []string{}
+	if tbl, ok := L.GetField(opt, "choices").(*lua.LTable); ok {
+		tbl.ForEach(func(_, v lua.LValue) {
+			choices = append(choices, v.String())
+		})
+	}
+	conversations.Ask(L, client, e, question, choices, timeout)
+	return L.Yield()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/yuin/gopher-lua"
+)
+
+// threadChatClient records messages sent to threads.
+type threadChatClient struct {
+	testChatClient
+}
+
+func (client *threadChatClient) ReplyInThread(target, thread, message string) error {
+	client.sent = append(client.sent, target+"/"+thread+":"+message)
+	return nil
+}
+
+func TestConversationKey(t *testing.T) {
+	e := NewMessageEvent("U1", "alice", "C1", "#ops", "deploy", &slack.MessageEvent{ThreadTimestamp: "1.5"})
+	if key := newConversationKey(e); key != (conversationKey{"U1", "C1", "1.5"}) {
+		t.Errorf("unexpected key: %v", key)
+	}
+	e = NewMessageEvent("", "alice", "room", "room", "deploy", nil)
+	if key := newConversationKey(e); key != (conversationKey{"alice", "room", ""}) {
+		t.Errorf("senders without ids must be keyed by name, got %v", key)
+	}
+}
+
+func TestConversationInThread(t *testing.T) {
+	client := &threadChatClient{testChatClient{failAfter: -1}}
+	client.commonOption = &CommonClientOption{Logger: log.New(ioutil.Discard, "", 0), Outbox: newOutbox()}
+	client.commonOption.Outbox.SetConnected(true)
+	mention := regexp.MustCompile("^golbot\\s+")
+	inThread := func(message string) *MessageEvent {
+		return NewMessageEvent("U1", "alice", "C1", "#ops", message, &slack.MessageEvent{ThreadTimestamp: "1.5"})
+	}
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("ask", L.NewFunction(func(L *lua.LState) int {
+		conversations.Ask(L, client, inThread("golbot deploy"), "deploy?", []string{"yes", "no"}, time.Minute)
+		return L.Yield()
+	}))
+	fn, err := L.LoadString(`answer = ask()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conversations.Start(L, client, fn); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.sent, []string{"#ops/1.5:deploy? (yes/no)"}) {
+		t.Fatalf("the question must be posted into the thread, got %v", client.sent)
+	}
+	if conversations.Answer(client, NewMessageEvent("U1", "alice", "C1", "#ops", "yes", &slack.MessageEvent{}), mention) {
+		t.Errorf("messages outside the thread must not be answers")
+	}
+	if !conversations.Answer(client, inThread("golbot maybe"), mention) {
+		t.Errorf("expected the message to be an answer")
+	}
+	if !conversations.Answer(client, inThread("golbot YES"), mention) {
+		t.Errorf("expected the message to be an answer")
+	}
+	if !reflect.DeepEqual(client.sent, []string{"#ops/1.5:deploy? (yes/no)", "#ops/1.5:Please answer yes/no"}) {
+		t.Errorf("unexpected messages: %v", client.sent)
+	}
+	if answer := L.GetGlobal("answer"); answer.String() != "yes" {
+		t.Errorf("expected yes, got %v", answer)
+	}
+	if conversations.Uses(L) {
+		t.Errorf("the conversation must be finished")
+	}
+}
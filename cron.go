@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/yuin/gopher-lua"
+)
+
+var cronRunner *cron.Cron
+var cronJobs []*cronJob
+
+// locationSchedule calculates next run times in the location.
+type locationSchedule struct {
+	cron.Schedule
+	location *time.Location
+}
+
+func (s *locationSchedule) Next(t time.Time) time.Time {
+	return s.Schedule.Next(t.In(s.location))
+}
+
+type cronJobStatus struct {
+	Name         string    `json:"name"`
+	Spec         string    `json:"spec"`
+	Timezone     string    `json:"timezone"`
+	Running      int       `json:"running"`
+	Skipped      int64     `json:"skipped"`
+	LastRun      time.Time `json:"last_run"`
+	LastDuration float64   `json:"last_duration"`
+	LastError    string    `json:"last_error"`
+	NextRun      time.Time `json:"next_run"`
+}
+
+type cronJob struct {
+	sync.Mutex
+	entry  CronEntry
+	logger *log.Logger
+	status cronJobStatus
+}
+
+func (cj *cronJob) Run() {
+	cj.Lock()
+	if cj.entry.SkipIfRunning && cj.status.Running > 0 {
+		cj.status.Skipped++
+		cj.Unlock()
+		cj.logger.Printf("[WARN] cron '%s' skipped, previous run is still running", cj.entry.FuncName)
+		return
+	}
+	cj.status.Running++
+	cj.Unlock()
+	// a run waiting for the jitter counts as running
+	if cj.entry.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(cj.entry.Jitter))))
+	}
+
+	cj.logger.Printf("[INFO] cron '%s' started", cj.entry.FuncName)
+	started := time.Now()
+	L := luaPool.Get()
+	defer luaPool.Put(L)
+	L.Push(L.GetGlobal(cj.entry.FuncName))
+	timeout := cj.entry.Timeout
+	if timeout == 0 {
+		timeout = handlerTimeouts.Get("cron")
+	}
+	err := withDeadline(L, "cron", timeout, func() error {
+		return L.PCall(0, 0, nil)
+	})
+	if err != nil {
+		cj.logger.Printf("[ERROR] cron '%s' : %s", cj.entry.FuncName, err.Error())
+	} else {
+		cj.logger.Printf("[INFO] cron '%s' successfully completed", cj.entry.FuncName)
+	}
+
+	metricCronDuration.Observe(time.Since(started).Seconds(), cj.entry.FuncName)
+	if err != nil {
+		metricCronErrors.Add(1, cj.entry.FuncName)
+	}
+
+	cj.Lock()
+	defer cj.Unlock()
+	cj.status.Running--
+	cj.status.LastRun = started
+	cj.status.LastDuration = time.Since(started).Seconds()
+	cj.status.LastError = ""
+	if err != nil {
+		cj.status.LastError = err.Error()
+	}
+}
+
+func (cj *cronJob) Status() cronJobStatus {
+	cj.Lock()
+	defer cj.Unlock()
+	return cj.status
+}
+
+func loadCronEntry(L *lua.LState, tbl *lua.LTable) CronEntry {
+	entry := CronEntry{Spec: tbl.RawGetInt(1).String(), FuncName: tbl.RawGetInt(2).String(), Location: time.Local}
+	if _, err := cron.Parse(entry.Spec); err != nil {
+		L.RaiseError("crons: '%s': %s", entry.Spec, err.Error())
+	}
+	if s, ok := getStringField(L, tbl, "timezone"); ok {
+		loc, err := time.LoadLocation(s)
+		if err != nil {
+			L.RaiseError("crons: %s", err.Error())
+		}
+		entry.Location = loc
+	}
+	entry.SkipIfRunning = lua.LVAsBool(L.GetField(tbl, "skip_if_running"))
+	if n, ok := getNumberField(L, tbl, "jitter"); ok {
+		entry.Jitter = time.Duration(n * float64(time.Second))
+	}
+	if n, ok := getNumberField(L, tbl, "timeout"); ok {
+		entry.Timeout = time.Duration(n * float64(time.Second))
+	}
+	return entry
+}
+
+func startCrons(co *CommonClientOption) {
+	if co.Crons == nil {
+		return
+	}
+	c := cron.New()
+	c.ErrorLog = co.Logger
+	for _, entry := range co.Crons {
+		schedule, _ := cron.Parse(entry.Spec)
+		job := &cronJob{entry: entry, logger: co.Logger}
+		job.status.Name = entry.FuncName
+		job.status.Spec = entry.Spec
+		job.status.Timezone = entry.Location.String()
+		c.Schedule(&locationSchedule{schedule, entry.Location}, job)
+		cronJobs = append(cronJobs, job)
+	}
+	c.Start()
+	cronRunner = c
+}
+
+// cronStatuses returns statuses of cron jobs with next run times.
+func cronStatuses() []cronJobStatus {
+	next := map[*cronJob]time.Time{}
+	if cronRunner != nil {
+		for _, e := range cronRunner.Entries() {
+			if job, ok := e.Job.(*cronJob); ok {
+				next[job] = e.Next
+			}
+		}
+	}
+	statuses := make([]cronJobStatus, 0, len(cronJobs))
+	for _, job := range cronJobs {
+		status := job.Status()
+		status.NextRun = next[job]
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func serveCronStatuses(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(cronStatuses())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
+
+func unixTimeOrNil(t time.Time) lua.LValue {
+	if t.IsZero() {
+		return lua.LNil
+	}
+	return lua.LNumber(t.Unix())
+}
+
+var cronsMod = map[string]lua.LGFunction{
+	"list": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		for _, s := range cronStatuses() {
+			stbl := L.NewTable()
+			stbl.RawSetString("name", lua.LString(s.Name))
+			stbl.RawSetString("spec", lua.LString(s.Spec))
+			stbl.RawSetString("timezone", lua.LString(s.Timezone))
+			stbl.RawSetString("running", lua.LNumber(s.Running))
+			stbl.RawSetString("skipped", lua.LNumber(s.Skipped))
+			stbl.RawSetString("last_run", unixTimeOrNil(s.LastRun))
+			stbl.RawSetString("last_duration", lua.LNumber(s.LastDuration))
+			if len(s.LastError) != 0 {
+				stbl.RawSetString("last_error", lua.LString(s.LastError))
+			}
+			stbl.RawSetString("next_run", unixTimeOrNil(s.NextRun))
+			tbl.Append(stbl)
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
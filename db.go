@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yuin/gopher-lua"
+)
+
+const dbConnTypeName = "dbConn"
+const dbTxTypeName = "dbTx"
+
+// dbDriverAliases maps driver names used in scripts to names registered in
+// database/sql. Add blank imports of drivers and aliases here to use other databases.
+var dbDriverAliases = map[string]string{
+	"sqlite":  "sqlite3",
+	"sqlite3": "sqlite3",
+}
+
+type dbConfig struct {
+	Driver      string
+	Dsn         string
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+}
+
+// dbRegistry keeps connection pools shared by all Lua states and
+// transactions started by begin.
+type dbRegistry struct {
+	sync.Mutex
+	dbs     map[string]*sql.DB
+	sources map[string]string
+	// Lua states that started transactions
+	txs    map[*sql.Tx]*lua.LState
+	logger *log.Logger
+}
+
+var databases = &dbRegistry{
+	dbs:     make(map[string]*sql.DB),
+	sources: make(map[string]string),
+	txs:     make(map[*sql.Tx]*lua.LState),
+}
+
+func (r *dbRegistry) SetLogger(logger *log.Logger) {
+	r.Lock()
+	defer r.Unlock()
+	r.logger = logger
+}
+
+func (r *dbRegistry) Open(name string, conf dbConfig) (*sql.DB, error) {
+	r.Lock()
+	defer r.Unlock()
+	driver, ok := dbDriverAliases[conf.Driver]
+	if !ok {
+		driver = conf.Driver
+	}
+	source := driver + " " + conf.Dsn
+	if db, ok := r.dbs[name]; ok {
+		if r.sources[name] != source {
+			return nil, fmt.Errorf("database '%s' is already opened with another driver or dsn", name)
+		}
+		return db, nil
+	}
+	db, err := sql.Open(driver, conf.Dsn)
+	if err != nil {
+		return nil, err
+	}
+	if conf.MaxOpen > 0 {
+		db.SetMaxOpenConns(conf.MaxOpen)
+	}
+	if conf.MaxIdle > 0 {
+		db.SetMaxIdleConns(conf.MaxIdle)
+	}
+	if conf.MaxLifetime > 0 {
+		db.SetConnMaxLifetime(conf.MaxLifetime)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	r.dbs[name] = db
+	r.sources[name] = source
+	return db, nil
+}
+
+func (r *dbRegistry) Get(name string) (*sql.DB, bool) {
+	r.Lock()
+	defer r.Unlock()
+	db, ok := r.dbs[name]
+	return db, ok
+}
+
+func (r *dbRegistry) Close(name string) error {
+	r.Lock()
+	defer r.Unlock()
+	db, ok := r.dbs[name]
+	if !ok {
+		return nil
+	}
+	delete(r.dbs, name)
+	delete(r.sources, name)
+	return db.Close()
+}
+
+func (r *dbRegistry) CloseAll() {
+	r.Lock()
+	defer r.Unlock()
+	for name, db := range r.dbs {
+		db.Close()
+		delete(r.dbs, name)
+		delete(r.sources, name)
+	}
+}
+
+// Track records the transaction started by L until it is committed or rolled back.
+func (r *dbRegistry) Track(L *lua.LState, tx *sql.Tx) {
+	r.Lock()
+	defer r.Unlock()
+	r.txs[tx] = L
+}
+
+func (r *dbRegistry) Untrack(tx *sql.Tx) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.txs, tx)
+}
+
+// Rollback rolls back transactions that L did not finish. If threads is true,
+// transactions of coroutines in L are rolled back too.
+func (r *dbRegistry) Rollback(L *lua.LState, threads bool) {
+	r.Lock()
+	txs := []*sql.Tx{}
+	for tx, owner := range r.txs {
+		if owner == L || (threads && owner.G == L.G) {
+			txs = append(txs, tx)
+			delete(r.txs, tx)
+		}
+	}
+	logger := r.logger
+	r.Unlock()
+	for _, tx := range txs {
+		err := tx.Rollback()
+		if logger == nil {
+			continue
+		}
+		if err != nil && err != sql.ErrTxDone {
+			logger.Printf("[ERROR] db: failed to roll back an unfinished transaction: %s", err.Error())
+		} else {
+			logger.Printf("[WARN] db: rolled back a transaction that was not committed")
+		}
+	}
+}
+
+func loadDbConfig(L *lua.LState, tbl *lua.LTable) dbConfig {
+	conf := dbConfig{}
+	conf.Driver, _ = getStringField(L, tbl, "driver")
+	conf.Dsn, _ = getStringField(L, tbl, "dsn")
+	if len(conf.Driver) == 0 {
+		L.RaiseError("db: 'driver' is required")
+	}
+	if n, ok := getNumberField(L, tbl, "max_open"); ok {
+		conf.MaxOpen = int(n)
+	}
+	if n, ok := getNumberField(L, tbl, "max_idle"); ok {
+		conf.MaxIdle = int(n)
+	}
+	if n, ok := getNumberField(L, tbl, "max_lifetime"); ok {
+		conf.MaxLifetime = time.Duration(n * float64(time.Second))
+	}
+	return conf
+}
+
+func loadDatabasesOption(L *lua.LState, tbl *lua.LTable) {
+	tbl.ForEach(func(key, value lua.LValue) {
+		conf, ok := value.(*lua.LTable)
+		if !ok {
+			L.RaiseError("db: database '%s' must be a table", key.String())
+		}
+		if _, err := databases.Open(key.String(), loadDbConfig(L, conf)); err != nil {
+			L.RaiseError("db: %s", err.Error())
+		}
+	})
+}
+
+// dbQueryer is implemented by *sql.DB and *sql.Tx.
+type dbQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func dbArgs(L *lua.LState, start int) []interface{} {
+	args := []interface{}{}
+	for i := start; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LNumber:
+			if f := float64(v); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				args = append(args, int64(f))
+			} else {
+				args = append(args, f)
+			}
+		case lua.LString:
+			args = append(args, string(v))
+		case lua.LBool:
+			args = append(args, bool(v))
+		case *lua.LNilType:
+			args = append(args, nil)
+		default:
+			L.ArgError(i, fmt.Sprintf("%s can not be used as a query parameter", v.Type().String()))
+		}
+	}
+	return args
+}
+
+func dbToLua(v interface{}) lua.LValue {
+	switch x := v.(type) {
+	case nil:
+		return lua.LNil
+	case int64:
+		return lua.LNumber(x)
+	case float64:
+		return lua.LNumber(x)
+	case bool:
+		return lua.LBool(x)
+	case []byte:
+		return lua.LString(x)
+	case string:
+		return lua.LString(x)
+	case time.Time:
+		return lua.LString(x.Format(time.RFC3339))
+	default:
+		return lua.LString(fmt.Sprint(x))
+	}
+}
+
+func dbQuery(L *lua.LState, q dbQueryer, query string, args []interface{}) (*lua.LTable, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := L.NewTable()
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := L.NewTable()
+		for i, column := range columns {
+			row.RawSetString(column, dbToLua(values[i]))
+		}
+		result.Append(row)
+	}
+	return result, rows.Err()
+}
+
+func checkDbQueryer(L *lua.LState) dbQueryer {
+	ud := L.CheckUserData(1)
+	switch v := ud.Value.(type) {
+	case *sql.DB:
+		return v
+	case *sql.Tx:
+		return v
+	}
+	L.ArgError(1, "db connection or transaction expected")
+	return nil
+}
+
+func checkDb(L *lua.LState) *sql.DB {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*sql.DB); ok {
+		return v
+	}
+	L.ArgError(1, "db connection expected")
+	return nil
+}
+
+func checkDbTx(L *lua.LState) *sql.Tx {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*sql.Tx); ok {
+		return v
+	}
+	L.ArgError(1, "db transaction expected")
+	return nil
+}
+
+func newDbUserData(L *lua.LState, v interface{}, typeName string) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = v
+	L.SetMetatable(ud, L.GetTypeMetatable(typeName))
+	return ud
+}
+
+func dbExec(L *lua.LState) int {
+	result, err := checkDbQueryer(L).Exec(L.CheckString(2), dbArgs(L, 3)...)
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	affected, _ := result.RowsAffected()
+	lastId, _ := result.LastInsertId()
+	pushN(L, lua.LNumber(affected), lua.LNumber(lastId))
+	return 2
+}
+
+func dbQueryRows(L *lua.LState) int {
+	rows, err := dbQuery(L, checkDbQueryer(L), L.CheckString(2), dbArgs(L, 3))
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(rows)
+	return 1
+}
+
+func dbQueryRow(L *lua.LState) int {
+	rows, err := dbQuery(L, checkDbQueryer(L), L.CheckString(2), dbArgs(L, 3))
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(rows.RawGetInt(1))
+	return 1
+}
+
+var dbConnMethods = map[string]lua.LGFunction{
+	"exec":     dbExec,
+	"query":    dbQueryRows,
+	"queryrow": dbQueryRow,
+	"begin": func(L *lua.LState) int {
+		tx, err := checkDb(L).Begin()
+		if err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		databases.Track(L, tx)
+		L.Push(newDbUserData(L, tx, dbTxTypeName))
+		return 1
+	},
+	"transaction": func(L *lua.LState) int {
+		fn := L.CheckFunction(2)
+		tx, err := checkDb(L).Begin()
+		if err != nil {
+			pushN(L, lua.LFalse, lua.LString(err.Error()))
+			return 2
+		}
+		pushN(L, fn, newDbUserData(L, tx, dbTxTypeName))
+		if err := L.PCall(1, 0, nil); err != nil {
+			tx.Rollback()
+			pushN(L, lua.LFalse, lua.LString(err.Error()))
+			return 2
+		}
+		if err := tx.Commit(); err != nil {
+			pushN(L, lua.LFalse, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	},
+}
+
+var dbTxMethods = map[string]lua.LGFunction{
+	"exec":     dbExec,
+	"query":    dbQueryRows,
+	"queryrow": dbQueryRow,
+	"commit": func(L *lua.LState) int {
+		tx := checkDbTx(L)
+		databases.Untrack(tx)
+		if err := tx.Commit(); err != nil {
+			pushN(L, lua.LFalse, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	},
+	"rollback": func(L *lua.LState) int {
+		tx := checkDbTx(L)
+		databases.Untrack(tx)
+		if err := tx.Rollback(); err != nil {
+			pushN(L, lua.LFalse, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	},
+}
+
+var dbMod = map[string]lua.LGFunction{
+	"open": func(L *lua.LState) int {
+		name := L.CheckString(1)
+		conf := L.OptTable(4, L.NewTable())
+		L.SetField(conf, "driver", L.Get(2))
+		L.SetField(conf, "dsn", lua.LString(L.CheckString(3)))
+		db, err := databases.Open(name, loadDbConfig(L, conf))
+		if err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(newDbUserData(L, db, dbConnTypeName))
+		return 1
+	},
+	"get": func(L *lua.LState) int {
+		name := L.CheckString(1)
+		db, ok := databases.Get(name)
+		if !ok {
+			pushN(L, lua.LNil, lua.LString(fmt.Sprintf("database '%s' is not opened", name)))
+			return 2
+		}
+		L.Push(newDbUserData(L, db, dbConnTypeName))
+		return 1
+	},
+	"close": func(L *lua.LState) int {
+		if err := databases.Close(L.CheckString(1)); err != nil {
+			pushN(L, lua.LFalse, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LTrue)
+		return 1
+	},
+	"drivers": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		for _, name := range sql.Drivers() {
+			tbl.Append(lua.LString(name))
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
+
+func dbLoader(L *lua.LState) int {
+	for typeName, methods := range map[string]map[string]lua.LGFunction{
+		dbConnTypeName: dbConnMethods,
+		dbTxTypeName:   dbTxMethods,
+	} {
+		mt := L.NewTypeMetatable(typeName)
+		L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), methods))
+	}
+	L.Push(L.SetFuncs(L.NewTable(), dbMod))
+	return 1
+}
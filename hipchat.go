@@ -2,9 +2,10 @@ package main
 
 import (
 	"log"
-	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/daneharrigan/hipchat"
 	"github.com/yuin/gopher-lua"
@@ -51,34 +52,60 @@ const hipchatDefaultConfigLua = `  myname = "golbot"
   end)
 `
 
+const (
+	// the roster is requested at this interval to detect lost connections
+	hipchatPingInterval = time.Minute
+	hipchatPingTimeout  = 30 * time.Second
+)
+
 type hipchatChatClient struct {
+	// guards hipchatobj that is replaced after reconnecting
+	sync.RWMutex
 	hipchatobj   *hipchat.Client
 	commonOption *CommonClientOption
 	logger       *log.Logger
-	callbacks    map[string][]*lua.LFunction
+	handlers     *chatHandlers
 	roomsJids    []string
 	name         string
 	mentionName  string
+	user         string
+	password     string
+	resource     string
+	authType     string
 }
 
-func (client *hipchatChatClient) applyCallback(L *lua.LState, msg interface{}) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (client *hipchatChatClient) applyCallback(msg interface{}) {
 	typ := "message"
-	switch msg.(type) {
+	var me *MessageEvent
+	mention := regexp.MustCompile("@" + client.mentionName + "\\s+")
+	switch e := msg.(type) {
 	case *hipchat.Message:
 		typ = "message"
+		parts := strings.SplitN(e.From, "/", 2)
+		if len(parts) == 2 && parts[1] != client.name {
+			me = NewMessageEvent(client.userJid(parts[0], parts[1]), parts[1], parts[0], parts[0], e.Body, e)
+			if throttled(client, me, mention) {
+				return
+			}
+		}
 	}
-	v, ok := client.callbacks[typ]
-	if !ok {
-		return
+	mutex.Lock()
+	defer mutex.Unlock()
+	client.handlers.Apply(luaMain.L, client.logger, typ, msg)
+	if me != nil {
+		dispatchMessage(luaMain.L, client, me, mention)
 	}
-	for _, callback := range v {
-		pushN(L, callback, luar.New(L, msg))
-		if err := L.PCall(1, 0, nil); err != nil {
-			client.logger.Printf("[ERROR] %s", err.Error())
+}
+
+// userJid returns a JID of the sender. Room messages only have nicknames that
+// users can change, so senders in rooms have no ids.
+func (client *hipchatChatClient) userJid(from, name string) string {
+	for _, jid := range client.roomsJids {
+		if jid == from {
+			return ""
 		}
 	}
+	return from
 }
 
 func (client *hipchatChatClient) Logger() *log.Logger {
@@ -89,48 +116,74 @@ func (client *hipchatChatClient) CommonOption() *CommonClientOption {
 	return client.commonOption
 }
 
-func (client *hipchatChatClient) Say(target, message string) {
-	client.hipchatobj.Say(target, client.name, message)
+func (client *hipchatChatClient) Raw() interface{} {
+	return client.conn()
 }
 
-func (client *hipchatChatClient) On(L *lua.LState, typ string, callback *lua.LFunction) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	v, ok := client.callbacks[typ]
-	if !ok {
-		v = []*lua.LFunction{}
-		client.callbacks[typ] = v
+func (client *hipchatChatClient) Handlers() *chatHandlers {
+	return client.handlers
+}
+
+func (client *hipchatChatClient) SetHandlers(handlers *chatHandlers) {
+	client.handlers = handlers
+}
+
+func (client *hipchatChatClient) Channels() []string {
+	return client.roomsJids
+}
+
+func (client *hipchatChatClient) Say(target, message string) error {
+	client.conn().Say(target, client.name, message)
+	return nil
+}
+
+func (client *hipchatChatClient) conn() *hipchat.Client {
+	client.RLock()
+	defer client.RUnlock()
+	return client.hipchatobj
+}
+
+func (client *hipchatChatClient) connect() error {
+	hipchatobj, err := hipchat.NewClient(client.user, client.password, client.resource, client.authType)
+	if err != nil {
+		return err
 	}
-	client.callbacks[typ] = append(v, callback)
+	client.Lock()
+	defer client.Unlock()
+	client.hipchatobj = hipchatobj
+	return nil
+}
+
+func (client *hipchatChatClient) On(L *lua.LState, typ string, callback *lua.LFunction) {
+	client.handlers.On(typ, callback)
 }
 
 func (client *hipchatChatClient) Respond(L *lua.LState, pattern *regexp.Regexp, fn *lua.LFunction) {
-	client.On(L, "message", L.NewFunction(func(L *lua.LState) int {
-		e := L.CheckUserData(1).Value.(*hipchat.Message)
-		matches := pattern.FindAllStringSubmatch(e.Body, -1)
-		mentionMe, _ := regexp.MatchString("@"+client.mentionName+"\\s+", e.Body)
-		if len(matches) > 0 && mentionMe {
-			to := strings.Split(e.From, "/")[0]
-			user := strings.Split(e.From, "/")[1]
-			if user == client.name {
-				return 0
-			}
-			pushN(L, fn, luar.New(L, matches[0]), luar.New(L, NewMessageEvent(user, to, e.Body, e)))
-			if err := L.PCall(2, 0, nil); err != nil {
-				client.logger.Printf("[ERROR] %s", err.Error())
-			}
-		}
-		return 0
-	}))
+	client.handlers.Respond(pattern, fn)
 }
 
+// Serve joins rooms when the roster is received. The Hipchat client does not
+// report lost connections, so the roster is requested periodically and the
+// client reconnects if the server does not respond.
 func (client *hipchatChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
-	hipchatobj := client.hipchatobj
-	hipchatobj.RequestUsers()
+	hipchatobj := client.conn()
+	joined := false
+	var timeout <-chan time.Time
+	requestUsers := func() {
+		hipchatobj.RequestUsers()
+		timeout = time.After(hipchatPingTimeout)
+	}
+	requestUsers()
+	ping := time.NewTicker(hipchatPingInterval)
+	defer ping.Stop()
 
 	for {
 		select {
 		case users := <-hipchatobj.Users():
+			timeout = nil
+			if joined {
+				continue
+			}
 			for _, user := range users {
 				if user.Id == hipchatobj.Id {
 					client.name = user.Name
@@ -143,15 +196,30 @@ func (client *hipchatChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
 				hipchatobj.Join(jid, client.name)
 			}
 			hipchatobj.Status("chat")
+			joined = true
+			emitConnectionEvent(client, "connected", "")
 		case msg := <-hipchatobj.Messages():
-			client.applyCallback(L, msg)
+			client.applyCallback(msg)
+		case <-ping.C:
+			if timeout == nil {
+				requestUsers()
+			}
+		case <-timeout:
+			client.logger.Printf("[ERROR] disconnected: no response from the server")
+			emitConnectionEvent(client, "disconnected", "no response from the server")
+			if reconnect(client.commonOption, client.connect) != nil {
+				return
+			}
+			hipchatobj = client.conn()
+			joined = false
+			requestUsers()
 		case msg := <-luaMainChan:
-			func() {
-				mutex.Lock()
-				defer mutex.Unlock()
-				pushN(L, fn, msg)
-				L.PCall(1, 0, nil)
-			}()
+			callServe(msg)
+		case <-shutdownChan:
+			for _, jid := range client.roomsJids {
+				hipchatobj.Part(jid, client.name)
+			}
+			return
 		}
 	}
 }
@@ -184,16 +252,20 @@ func newHipchatChatClient(L *lua.LState, co *CommonClientOption, opt *lua.LTable
 	}
 	roomJids := L.GetField(opt, "room_jids")
 
-	if co.Logger == nil {
-		co.Logger = log.New(os.Stdout, "", log.Lshortfile|log.LstdFlags)
+	chatClient := &hipchatChatClient{
+		commonOption: co,
+		logger:       co.Logger,
+		handlers:     newChatHandlers(),
+		roomsJids:    []string{},
+		user:         user,
+		password:     password,
+		resource:     resource,
+		authType:     authType,
 	}
-	hipchatobj, err := hipchat.NewClient(user, password, resource, authType)
-	if err != nil {
-		co.Logger.Printf("[ERROR] %s", err.Error())
-		os.Exit(1)
+	if err := reconnect(co, chatClient.connect); err != nil {
+		L.RaiseError(err.Error())
 	}
 	co.Logger.Printf("[INFO] connected to %s", host)
-	chatClient := &hipchatChatClient{hipchatobj, co, co.Logger, make(map[string][]*lua.LFunction), []string{}, "", ""}
 	if tbl, ok := roomJids.(*lua.LTable); ok {
 		tbl.ForEach(func(key, value lua.LValue) {
 			chatClient.roomsJids = append(chatClient.roomsJids, value.String())
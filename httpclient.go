@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -24,6 +25,8 @@ type httpRequestParam struct {
 	Params []string
 	// Additional HTTP headers
 	Headers []string
+	// Cancels the request if not nil
+	Context context.Context
 }
 
 var httpDefaultHeaders []string = []string{}
@@ -57,6 +60,9 @@ func httpRequest(p httpRequestParam) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	if p.Context != nil {
+		req = req.WithContext(p.Context)
+	}
 	httpDefaultHeaders := []string{}
 	for i := 0; i < len(httpDefaultHeaders); i += 2 {
 		if req.Header.Get(httpDefaultHeaders[i]) == "" {
@@ -108,6 +114,7 @@ var requestsMod map[string]lua.LGFunction = map[string]lua.LGFunction{
 			})
 			param.Headers = headers
 		}
+		param.Context = L.Context()
 		res, err := httpRequest(param)
 		if err != nil {
 			pushN(L, lua.LNil, lua.LString(err.Error()))
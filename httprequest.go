@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// defaultMaxBodySize is the default size limit of request bodies.
+const defaultMaxBodySize = 10 << 20
+
+// maxFormMemory is the size of multipart forms kept in memory. Larger files
+// are stored in temporary files.
+const maxFormMemory = 32 << 20
+
+// readRequestBody reads the body and restores it, so that the body can be read
+// more than once.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// bodyErrorStatus returns an http status for errors of reading request bodies.
+func bodyErrorStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func parseRequestForm(r *http.Request) error {
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil && err != http.ErrNotMultipart {
+		return err
+	}
+	return nil
+}
+
+// pushValues pushes the first value of the name, or a table of first values
+// and a table of all values if the name is omitted.
+func pushValues(L *lua.LState, values url.Values) int {
+	if L.GetTop() > 1 {
+		if vs, ok := values[L.CheckString(2)]; ok && len(vs) != 0 {
+			L.Push(lua.LString(vs[0]))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}
+	first := L.NewTable()
+	all := L.NewTable()
+	for name, vs := range values {
+		list := L.NewTable()
+		for _, v := range vs {
+			list.Append(lua.LString(v))
+		}
+		if len(vs) != 0 {
+			first.RawSetString(name, lua.LString(vs[0]))
+		}
+		all.RawSetString(name, list)
+	}
+	pushN(L, first, all)
+	return 2
+}
+
+func pushError(L *lua.LState, err error) int {
+	pushN(L, lua.LNil, lua.LString(err.Error()))
+	return 2
+}
+
+func checkHttpRequest(L *lua.LState) *http.Request {
+	if r, ok := L.CheckUserData(1).Value.(*http.Request); ok {
+		return r
+	}
+	L.ArgError(1, "http request expected")
+	return nil
+}
+
+var httpRequestMethods = map[string]lua.LGFunction{
+	"readbody": func(L *lua.LState) int {
+		b, err := readRequestBody(checkHttpRequest(L))
+		if err != nil {
+			return pushError(L, err)
+		}
+		L.Push(lua.LString(b))
+		return 1
+	},
+	"query": func(L *lua.LState) int {
+		return pushValues(L, checkHttpRequest(L).URL.Query())
+	},
+	"form": func(L *lua.LState) int {
+		r := checkHttpRequest(L)
+		if err := parseRequestForm(r); err != nil {
+			return pushError(L, err)
+		}
+		return pushValues(L, r.PostForm)
+	},
+	"json": func(L *lua.LState) int {
+		b, err := readRequestBody(checkHttpRequest(L))
+		if err != nil {
+			return pushError(L, err)
+		}
+		value, err := luajson.Decode(L, b)
+		if err != nil {
+			return pushError(L, err)
+		}
+		L.Push(value)
+		return 1
+	},
+	"file": func(L *lua.LState) int {
+		r := checkHttpRequest(L)
+		name := L.CheckString(2)
+		if err := parseRequestForm(r); err != nil {
+			return pushError(L, err)
+		}
+		f, fh, err := r.FormFile(name)
+		if err != nil {
+			return pushError(L, err)
+		}
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return pushError(L, err)
+		}
+		tbl := L.NewTable()
+		tbl.RawSetString("filename", lua.LString(fh.Filename))
+		tbl.RawSetString("size", lua.LNumber(fh.Size))
+		tbl.RawSetString("content_type", lua.LString(fh.Header.Get("Content-Type")))
+		tbl.RawSetString("content", lua.LString(b))
+		L.Push(tbl)
+		return 1
+	},
+	"header": func(L *lua.LState) int {
+		values := checkHttpRequest(L).Header.Values(L.CheckString(2))
+		if len(values) == 0 {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(values[0]))
+		}
+		return 1
+	},
+	"cookie": func(L *lua.LState) int {
+		c, err := checkHttpRequest(L).Cookie(L.CheckString(2))
+		if err != nil {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(c.Value))
+		}
+		return 1
+	},
+}
+
+func registerHttpRequestMethods(L *lua.LState) {
+	methods := map[string]*lua.LFunction{}
+	for name, fn := range httpRequestMethods {
+		methods[name] = L.NewFunction(fn)
+	}
+	addLuaMethod(L, &http.Request{}, func(L *lua.LState, key string) bool {
+		if key == "ReadBody" {
+			key = "readbody"
+		}
+		if fn, ok := methods[key]; ok {
+			L.Push(fn)
+			return true
+		}
+		return false
+	})
+}
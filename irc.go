@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"reflect"
 	"regexp"
 	"strings"
 	"time"
@@ -57,6 +56,9 @@ type ircChatClient struct {
 	commonOption *CommonClientOption
 	conn         string
 	nick         string
+	mention      *regexp.Regexp
+	handlers     *chatHandlers
+	actions      map[string]bool
 }
 
 func (client *ircChatClient) Logger() *log.Logger {
@@ -67,69 +69,72 @@ func (client *ircChatClient) CommonOption() *CommonClientOption {
 	return client.commonOption
 }
 
-func (client *ircChatClient) Say(target, message string) {
+func (client *ircChatClient) Raw() interface{} {
+	return client.ircobj
+}
+
+func (client *ircChatClient) Handlers() *chatHandlers {
+	return client.handlers
+}
+
+func (client *ircChatClient) SetHandlers(handlers *chatHandlers) {
+	client.handlers = handlers
+}
+
+func (client *ircChatClient) Channels() []string {
+	return strings.Split(client.conn, ",")[1:]
+}
+
+func (client *ircChatClient) Say(target, message string) error {
 	client.ircobj.Privmsg(target, message)
+	return nil
 }
 
 func (client *ircChatClient) On(L *lua.LState, action string, fn *lua.LFunction) {
-	client.ircobj.AddCallback(action, func(e *irc.Event) {
-		mutex.Lock()
-		defer mutex.Unlock()
-		pushN(L, fn, luar.New(L, e))
-		L.PCall(1, 0, nil)
-	})
+	if !client.actions[action] {
+		client.actions[action] = true
+		client.ircobj.AddCallback(action, func(e *irc.Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			client.handlers.Apply(luaMain.L, client.Logger(), action, e)
+		})
+	}
+	client.handlers.On(action, fn)
 }
 
 func (client *ircChatClient) Respond(L *lua.LState, pattern *regexp.Regexp, fn *lua.LFunction) {
-	client.ircobj.AddCallback("PRIVMSG", func(e *irc.Event) {
-		mutex.Lock()
-		defer mutex.Unlock()
-		matches := pattern.FindAllStringSubmatch(e.Message(), -1)
-		mentionMe, _ := regexp.MatchString("[@:\\\\]"+client.nick+"\\s+", e.Message())
-		if len(matches) != 0 && mentionMe {
-			pushN(L, fn, luar.New(L, matches[0]), luar.New(L, NewMessageEvent(e.Nick, e.Arguments[0], e.Message(), e)))
-			if err := L.PCall(2, 0, nil); err != nil {
-				client.ircobj.Log.Printf("[ERROR] %s", err.Error())
-			}
-		}
-	})
+	client.handlers.Respond(pattern, fn)
 }
 
 func (client *ircChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
 	irc := client.ircobj
 
 	if len(irc.Server) == 0 {
-		parts := strings.Split(client.conn, ",")
-		if err := irc.Connect(parts[0]); err != nil {
-			L.RaiseError(err.Error())
-		}
-		for i := 1; i < len(parts); i++ {
-			irc.Join(parts[i])
+		server := strings.Split(client.conn, ",")[0]
+		if err := reconnect(client.commonOption, func() error { return irc.Connect(server) }); err != nil {
+			return
 		}
 	}
 
-	v := reflect.ValueOf(*irc)
 	errChan := irc.ErrorChan()
-	for !v.FieldByName("quit").Bool() {
+	for {
 		select {
 		case err := <-errChan:
-			irc.Log.Printf("Error, disconnected: %s\n", err)
-			for !v.FieldByName("quit").Bool() {
-				if err = irc.Reconnect(); err != nil {
-					irc.Log.Printf("Error while reconnecting: %s\n", err)
-					time.Sleep(60 * time.Second)
-				} else {
-					errChan = irc.ErrorChan()
-					break
-				}
+			irc.Log.Printf("[ERROR] disconnected: %s", err)
+			emitConnectionEvent(client, "disconnected", err.Error())
+			if err := reconnect(client.commonOption, irc.Reconnect); err != nil {
+				return
 			}
+			errChan = irc.ErrorChan()
 		case msg := <-luaMainChan:
-			func() {
-				mutex.Lock()
-				defer mutex.Unlock()
-				pushN(L, fn, msg)
-				L.PCall(1, 0, nil)
-			}()
+			callServe(msg)
+		case <-shutdownChan:
+			irc.Quit()
+			select {
+			case <-errChan:
+			case <-time.After(5 * time.Second):
+			}
+			return
 		}
 	}
 }
@@ -146,11 +151,28 @@ func newIRCChatClient(L *lua.LState, co *CommonClientOption, opt *lua.LTable) {
 	}
 
 	ircobj := irc.IRC(nickname, username)
-	chatClient := &ircChatClient{ircobj, co, "127.0.0.1:6667", nickname}
+	chatClient := &ircChatClient{ircobj, co, "127.0.0.1:6667", nickname, regexp.MustCompile("[@:\\\\]" + nickname + "\\s+"), newChatHandlers(), make(map[string]bool)}
+	ircobj.AddCallback("PRIVMSG", func(e *irc.Event) {
+		me := NewMessageEvent(e.User+"@"+e.Host, e.Nick, e.Arguments[0], e.Arguments[0], e.Message(), e)
+		if throttled(chatClient, me, chatClient.mention) {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		dispatchMessage(luaMain.L, chatClient, me, chatClient.mention)
+	})
+	ircobj.AddCallback("JOIN", func(e *irc.Event) {
+		liveEvents.Publish(&liveEvent{Type: "join", Channel: e.Arguments[0], User: e.Nick, UserId: e.User + "@" + e.Host})
+	})
+	// joins channels after every connection
+	ircobj.AddCallback("001", func(e *irc.Event) {
+		for _, channel := range strings.Split(chatClient.conn, ",")[1:] {
+			ircobj.Join(channel)
+		}
+		emitConnectionEvent(chatClient, "connected", "")
+	})
 
-	if co.Logger != nil {
-		ircobj.Log = co.Logger
-	}
+	ircobj.Log = co.Logger
 	ircobj.UseTLS = lua.LVAsBool(L.GetField(opt, "useTLS"))
 	if s, ok := getStringField(L, opt, "password"); ok {
 		ircobj.Password = s
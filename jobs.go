@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const defaultJobQueue = "default"
+
+// jobCancelGrace is how long Drain waits for canceled jobs to return.
+var jobCancelGrace = 5 * time.Second
+
+type job struct {
+	id         int64
+	queue      *jobQueue
+	msg        lua.LValue
+	status     string
+	err        string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+type jobQueueConfig struct {
+	Workers int
+	Length  int
+	// "error", "block" or "drop_oldest"
+	Full   string
+	Worker string
+}
+
+type jobQueue struct {
+	name    string
+	conf    jobQueueConfig
+	jobs    chan *job
+	running int
+}
+
+// jobManager runs goworker calls in bounded worker pools. Each named queue has
+// its own workers and buffer.
+type jobManager struct {
+	sync.Mutex
+	queues    map[string]*jobQueue
+	jobs      map[int64]*job
+	lastId    int64
+	lastPrune time.Time
+	retention time.Duration
+	logger    *log.Logger
+	wg        sync.WaitGroup
+}
+
+var jobs = &jobManager{
+	queues:    make(map[string]*jobQueue),
+	jobs:      make(map[int64]*job),
+	retention: 10 * time.Minute,
+}
+
+var errJobQueueFull = errors.New("queue is full")
+
+func defaultJobQueueConfig() jobQueueConfig {
+	return jobQueueConfig{Workers: 4, Length: 100, Full: "error", Worker: "worker"}
+}
+
+func (m *jobManager) SetLogger(logger *log.Logger) {
+	m.Lock()
+	defer m.Unlock()
+	m.logger = logger
+}
+
+func (m *jobManager) logf(format string, args ...interface{}) {
+	if m.logger != nil {
+		m.logger.Printf(format, args...)
+	}
+}
+
+// AddQueue creates a queue and starts its workers. Queues can not be
+// reconfigured once they are created.
+func (m *jobManager) AddQueue(name string, conf jobQueueConfig) *jobQueue {
+	m.Lock()
+	defer m.Unlock()
+	return m.addQueue(name, conf)
+}
+
+func (m *jobManager) addQueue(name string, conf jobQueueConfig) *jobQueue {
+	if q, ok := m.queues[name]; ok {
+		return q
+	}
+	q := &jobQueue{name, conf, make(chan *job, conf.Length), 0}
+	m.queues[name] = q
+	for i := 0; i < conf.Workers; i++ {
+		go m.work(q)
+	}
+	return q
+}
+
+func (m *jobManager) work(q *jobQueue) {
+	for j := range q.jobs {
+		m.run(j)
+	}
+}
+
+func (m *jobManager) run(j *job) {
+	defer m.wg.Done()
+	m.Lock()
+	if j.ctx.Err() != nil {
+		if j.finishedAt.IsZero() {
+			m.finish(j, "canceled")
+		}
+		m.Unlock()
+		return
+	}
+	j.status = "running"
+	j.startedAt = time.Now()
+	j.queue.running++
+	m.Unlock()
+
+	L := luaPool.Get()
+	L.SetContext(j.ctx)
+	pushN(L, L.GetGlobal(j.queue.conf.Worker), j.msg)
+	err := L.PCall(1, 0, nil)
+	L.RemoveContext()
+	luaPool.Put(L)
+	observeHandler("worker", j.startedAt, err)
+
+	m.Lock()
+	defer m.Unlock()
+	j.queue.running--
+	j.finishedAt = time.Now()
+	switch {
+	case j.ctx.Err() == context.Canceled:
+		j.status = "canceled"
+	case err != nil:
+		j.status = "failed"
+		j.err = err.Error()
+		m.logf("[ERROR] job %d(%s): %s", j.id, j.queue.name, j.err)
+	default:
+		j.status = "done"
+	}
+	j.cancel()
+}
+
+// prune removes finished jobs older than the retention period.
+func (m *jobManager) prune(now time.Time) {
+	if now.Sub(m.lastPrune) < time.Minute {
+		return
+	}
+	m.lastPrune = now
+	for id, j := range m.jobs {
+		if !j.finishedAt.IsZero() && now.Sub(j.finishedAt) > m.retention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *jobManager) finish(j *job, status string) {
+	j.status = status
+	j.finishedAt = time.Now()
+	j.cancel()
+}
+
+// Submit adds a job to the queue and returns its id.
+func (m *jobManager) Submit(queue string, msg lua.LValue) (int64, error) {
+	m.Lock()
+	q, ok := m.queues[queue]
+	if !ok {
+		if queue != defaultJobQueue {
+			m.Unlock()
+			return 0, fmt.Errorf("queue '%s' is not defined", queue)
+		}
+		q = m.addQueue(queue, defaultJobQueueConfig())
+	}
+	m.lastId++
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{id: m.lastId, queue: q, msg: msg, status: "queued", ctx: ctx, cancel: cancel, createdAt: time.Now()}
+	m.prune(j.createdAt)
+	m.jobs[j.id] = j
+	m.wg.Add(1)
+	for {
+		select {
+		case q.jobs <- j:
+			m.Unlock()
+			return j.id, nil
+		default:
+		}
+		switch q.conf.Full {
+		case "block":
+			m.Unlock()
+			select {
+			case q.jobs <- j:
+				return j.id, nil
+			case <-shutdownChan:
+				m.Lock()
+				delete(m.jobs, j.id)
+				m.Unlock()
+				m.wg.Done()
+				cancel()
+				return 0, errors.New("golbot is shutting down")
+			}
+		case "drop_oldest":
+			select {
+			case old := <-q.jobs:
+				// canceled jobs are removed without dropping others
+				if old.finishedAt.IsZero() {
+					m.finish(old, "dropped")
+					m.logf("[WARN] job %d(%s) dropped", old.id, q.name)
+				}
+				m.wg.Done()
+			default:
+			}
+		default:
+			delete(m.jobs, j.id)
+			m.wg.Done()
+			m.Unlock()
+			cancel()
+			return 0, errJobQueueFull
+		}
+	}
+}
+
+// Cancel cancels the job. Running jobs are stopped through the context of
+// their Lua states.
+func (m *jobManager) Cancel(id int64) bool {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok || !j.finishedAt.IsZero() {
+		return false
+	}
+	if j.status == "queued" {
+		m.finish(j, "canceled")
+		return true
+	}
+	j.cancel()
+	return true
+}
+
+// Drain waits for queued and running jobs. It cancels them all if ctx is done
+// before they finish, waits jobCancelGrace for them to return, and returns
+// false in that case.
+func (m *jobManager) Drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+	m.Lock()
+	for _, j := range m.jobs {
+		j.cancel()
+	}
+	m.Unlock()
+	select {
+	case <-done:
+	case <-time.After(jobCancelGrace):
+	}
+	return false
+}
+
+func (m *jobManager) Status(L *lua.LState, id int64) lua.LValue {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return lua.LNil
+	}
+	tbl := L.NewTable()
+	tbl.RawSetString("id", lua.LNumber(j.id))
+	tbl.RawSetString("queue", lua.LString(j.queue.name))
+	tbl.RawSetString("status", lua.LString(j.status))
+	if len(j.err) != 0 {
+		tbl.RawSetString("error", lua.LString(j.err))
+	}
+	for key, t := range map[string]time.Time{"created_at": j.createdAt, "started_at": j.startedAt, "finished_at": j.finishedAt} {
+		if !t.IsZero() {
+			tbl.RawSetString(key, lua.LNumber(t.Unix()))
+		}
+	}
+	return tbl
+}
+
+type jobQueueStats struct {
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+	Workers int `json:"workers"`
+	Length  int `json:"length"`
+}
+
+func (m *jobManager) Stats() map[string]jobQueueStats {
+	m.Lock()
+	defer m.Unlock()
+	queued := make(map[*jobQueue]int, len(m.queues))
+	for _, j := range m.jobs {
+		if j.status == "queued" {
+			queued[j.queue]++
+		}
+	}
+	stats := make(map[string]jobQueueStats, len(m.queues))
+	for name, q := range m.queues {
+		stats[name] = jobQueueStats{queued[q], q.running, q.conf.Workers, q.conf.Length}
+	}
+	return stats
+}
+
+func loadJobQueueConfig(L *lua.LState, conf jobQueueConfig, tbl *lua.LTable) jobQueueConfig {
+	if n, ok := getNumberField(L, tbl, "workers"); ok {
+		conf.Workers = int(n)
+	}
+	if n, ok := getNumberField(L, tbl, "length"); ok {
+		conf.Length = int(n)
+	}
+	if s, ok := getStringField(L, tbl, "full"); ok {
+		switch s {
+		case "error", "block", "drop_oldest":
+			conf.Full = s
+		default:
+			L.RaiseError("jobs: 'full' must be 'error', 'block' or 'drop_oldest'")
+		}
+	}
+	if s, ok := getStringField(L, tbl, "worker"); ok {
+		conf.Worker = s
+	}
+	if conf.Workers < 1 {
+		L.RaiseError("jobs: 'workers' must be greater than 0")
+	}
+	return conf
+}
+
+func loadJobsOption(L *lua.LState, tbl *lua.LTable) {
+	conf := loadJobQueueConfig(L, defaultJobQueueConfig(), tbl)
+	if queues, ok := L.GetField(tbl, "queues").(*lua.LTable); ok {
+		queues.ForEach(func(key, value lua.LValue) {
+			qtbl, ok := value.(*lua.LTable)
+			if !ok {
+				L.RaiseError("jobs: queue '%s' must be a table", key.String())
+			}
+			jobs.AddQueue(key.String(), loadJobQueueConfig(L, conf, qtbl))
+		})
+	}
+	jobs.AddQueue(defaultJobQueue, conf)
+}
+
+// luaWorkerChan is golbot.cworker. Messages sent to it are added to the default
+// queue like goworker.
+var luaWorkerChan chan lua.LValue
+
+func forwardWorkerChan(ch chan lua.LValue) {
+	for msg := range ch {
+		if _, err := jobs.Submit(defaultJobQueue, msg); err != nil {
+			jobs.Lock()
+			jobs.logf("[ERROR] golbot.cworker: %s", err.Error())
+			jobs.Unlock()
+		}
+	}
+}
+
+func goworker(L *lua.LState) int {
+	msg := L.CheckAny(1)
+	queue := defaultJobQueue
+	if opt, ok := L.Get(2).(*lua.LTable); ok {
+		if s, ok := getStringField(L, opt, "queue"); ok {
+			queue = s
+		}
+	}
+	id, err := jobs.Submit(queue, msg)
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(id))
+	return 1
+}
+
+var jobsMod = map[string]lua.LGFunction{
+	"status": func(L *lua.LState) int {
+		L.Push(jobs.Status(L, int64(L.CheckNumber(1))))
+		return 1
+	},
+	"cancel": func(L *lua.LState) int {
+		L.Push(lua.LBool(jobs.Cancel(int64(L.CheckNumber(1)))))
+		return 1
+	},
+	"canceled": func(L *lua.LState) int {
+		ctx := L.Context()
+		L.Push(lua.LBool(ctx != nil && ctx.Err() != nil))
+		return 1
+	},
+	"queues": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		for name, s := range jobs.Stats() {
+			qtbl := L.NewTable()
+			qtbl.RawSetString("queued", lua.LNumber(s.Queued))
+			qtbl.RawSetString("running", lua.LNumber(s.Running))
+			qtbl.RawSetString("workers", lua.LNumber(s.Workers))
+			qtbl.RawSetString("length", lua.LNumber(s.Length))
+			tbl.RawSetString(name, qtbl)
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cihub/seelog"
+	"github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// logLevel is a severity of log messages. Go code logs messages with a level
+// prefix like logger.Printf("[WARN] ...").
+type logLevel int32
+
+const (
+	logTrace logLevel = iota
+	logDebug
+	logInfo
+	logWarn
+	logError
+	logCritical
+)
+
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error", "critical"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, bool) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range logLevelNames {
+		if name == s {
+			return logLevel(i), true
+		}
+	}
+	return logInfo, false
+}
+
+// splitLogLevel splits a "[LEVEL] message" line. Lines without a known level
+// are info messages.
+func splitLogLevel(line string) (logLevel, string) {
+	line = strings.TrimRight(line, "\n")
+	if strings.HasPrefix(line, "[") {
+		if i := strings.IndexByte(line, ']'); i > 0 {
+			if level, ok := parseLogLevel(line[1:i]); ok {
+				return level, strings.TrimPrefix(line[i+1:], " ")
+			}
+		}
+	}
+	return logInfo, line
+}
+
+var currentLogLevel = int32(logInfo)
+
+// jsonLogFormat is 1 if messages are written as JSON lines.
+var jsonLogFormat int32
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+func setLogLevel(level logLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(level))
+}
+
+func setLogFormat(format string) bool {
+	if format != "text" && format != "json" {
+		return false
+	}
+	var v int32
+	if format == "json" {
+		v = 1
+	}
+	atomic.StoreInt32(&jsonLogFormat, v)
+	return true
+}
+
+func loadLogLevelOption(L *lua.LState, opt *lua.LTable) {
+	if s, ok := getStringField(L, opt, "log_level"); ok {
+		level, ok := parseLogLevel(s)
+		if !ok {
+			L.RaiseError("unknown log level: %s", s)
+		}
+		setLogLevel(level)
+	}
+}
+
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// logWriter filters messages by the current log level and writes them as text
+// or JSON lines. log.Loggers that write to a logWriter must not have flags.
+type logWriter struct {
+	sync.Mutex
+	out    io.Writer
+	seelog seelog.LoggerInterface
+}
+
+var defaultLogWriter = &logWriter{out: os.Stdout}
+
+// mainLogWriter holds the writer of the bot logger, used by golbot.log.
+var mainLogWriter atomic.Value
+
+func getMainLogWriter() *logWriter {
+	if w, ok := mainLogWriter.Load().(*logWriter); ok {
+		return w
+	}
+	return defaultLogWriter
+}
+
+func setMainLogWriter(w *logWriter) {
+	mainLogWriter.Store(w)
+}
+
+// Flush writes messages buffered by the seelog logger.
+func (w *logWriter) Flush() {
+	if w.seelog != nil {
+		w.seelog.Flush()
+	}
+}
+
+func newLogger(w *logWriter) *log.Logger {
+	return log.New(w, "", 0)
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	level, msg := splitLogLevel(string(p))
+	return len(p), w.Log(level, msg, nil)
+}
+
+func (w *logWriter) Log(level logLevel, msg string, fields []logField) error {
+	if level < getLogLevel() {
+		return nil
+	}
+	if w.seelog != nil {
+		line := w.format(time.Time{}, level, msg, fields)
+		switch level {
+		case logTrace:
+			w.seelog.Trace(line)
+		case logDebug:
+			w.seelog.Debug(line)
+		case logInfo:
+			w.seelog.Info(line)
+		case logWarn:
+			w.seelog.Warn(line)
+		case logError:
+			w.seelog.Error(line)
+		default:
+			w.seelog.Critical(line)
+		}
+		return nil
+	}
+	line := w.format(time.Now(), level, msg, fields)
+	w.Lock()
+	defer w.Unlock()
+	_, err := io.WriteString(w.out, line+"\n")
+	return err
+}
+
+// format formats a message. Messages passed to seelog have no timestamps and
+// levels in text format since seelog adds them.
+func (w *logWriter) format(t time.Time, level logLevel, msg string, fields []logField) string {
+	if atomic.LoadInt32(&jsonLogFormat) == 1 {
+		obj := map[string]interface{}{"level": level.String(), "msg": msg}
+		if !t.IsZero() {
+			obj["time"] = t.Format(time.RFC3339)
+		}
+		for _, f := range fields {
+			if _, ok := obj[f.Key]; !ok {
+				obj[f.Key] = f.Value
+			}
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return fmt.Sprintf(`{"level":"error","msg":%q}`, err.Error())
+		}
+		return string(b)
+	}
+	buf := []string{}
+	if !t.IsZero() {
+		buf = append(buf, t.Format("2006/01/02 15:04:05"), "["+strings.ToUpper(level.String())+"]")
+	}
+	buf = append(buf, msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if raw, ok := f.Value.(json.RawMessage); ok {
+			v = string(raw)
+		} else if strings.ContainsAny(v, " \t\n\"=") || len(v) == 0 {
+			v = strconv.Quote(v)
+		}
+		buf = append(buf, f.Key+"="+v)
+	}
+	return strings.Join(buf, " ")
+}
+
+func checkLogFields(L *lua.LState, n int) []logField {
+	tbl := L.OptTable(n, nil)
+	if tbl == nil {
+		return nil
+	}
+	fields := []logField{}
+	tbl.ForEach(func(k, v lua.LValue) {
+		f := logField{Key: k.String()}
+		switch lv := v.(type) {
+		case lua.LString:
+			f.Value = string(lv)
+		case lua.LBool:
+			f.Value = bool(lv)
+		case lua.LNumber:
+			f.Value = float64(lv)
+		default:
+			b, err := luajson.Encode(v)
+			if err != nil {
+				L.ArgError(n, err.Error())
+			}
+			f.Value = json.RawMessage(b)
+		}
+		fields = append(fields, f)
+	})
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+	return fields
+}
+
+func logFunc(level logLevel) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if err := getMainLogWriter().Log(level, L.CheckString(1), checkLogFields(L, 2)); err != nil {
+			L.RaiseError(err.Error())
+		}
+		return 0
+	}
+}
+
+var logMod = map[string]lua.LGFunction{
+	"trace":    logFunc(logTrace),
+	"debug":    logFunc(logDebug),
+	"info":     logFunc(logInfo),
+	"warn":     logFunc(logWarn),
+	"error":    logFunc(logError),
+	"critical": logFunc(logCritical),
+	"level": func(L *lua.LState) int {
+		if L.GetTop() > 0 {
+			level, ok := parseLogLevel(L.CheckString(1))
+			if !ok {
+				L.ArgError(1, "unknown log level: "+L.ToString(1))
+			}
+			setLogLevel(level)
+		}
+		L.Push(lua.LString(getLogLevel().String()))
+		return 1
+	},
+}
+
+// stepLogLevel changes the log level by delta within the valid range.
+func stepLogLevel(delta int) logLevel {
+	level := int(getLogLevel()) + delta
+	if level < int(logTrace) {
+		level = int(logTrace)
+	} else if level > int(logCritical) {
+		level = int(logCritical)
+	}
+	setLogLevel(logLevel(level))
+	return logLevel(level)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSplitLogLevel(t *testing.T) {
+	cases := []struct {
+		line    string
+		level   logLevel
+		message string
+	}{
+		{"[ERROR] failed\n", logError, "failed"},
+		{"[WARN] disk full", logWarn, "disk full"},
+		{"[warning] disk full", logWarn, "disk full"},
+		{"[DEBUG]no space", logDebug, "no space"},
+		{"[CRITICAL] down", logCritical, "down"},
+		{"started", logInfo, "started"},
+		{"[UNKNOWN] message", logInfo, "[UNKNOWN] message"},
+		{"[ERROR", logInfo, "[ERROR"},
+		{"", logInfo, ""},
+	}
+	for _, c := range cases {
+		level, message := splitLogLevel(c.line)
+		if level != c.level || message != c.message {
+			t.Errorf("%q: expected %s %q, got %s %q", c.line, c.level, c.message, level, message)
+		}
+	}
+}
+
+func TestStepLogLevel(t *testing.T) {
+	defer setLogLevel(getLogLevel())
+	setLogLevel(logDebug)
+	if level := stepLogLevel(-1); level != logTrace {
+		t.Errorf("expected trace, got %s", level)
+	}
+	if level := stepLogLevel(-1); level != logTrace {
+		t.Errorf("the level must not be lower than trace, got %s", level)
+	}
+	setLogLevel(logError)
+	if level := stepLogLevel(5); level != logCritical {
+		t.Errorf("the level must not be higher than critical, got %s", level)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	defer setLogLevel(getLogLevel())
+	defer setLogFormat("text")
+	setLogLevel(logInfo)
+	var buf bytes.Buffer
+	logger := newLogger(&logWriter{out: &buf})
+
+	logger.Printf("[DEBUG] hidden")
+	logger.Printf("[WARN] shown")
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], "[WARN] shown") {
+		t.Errorf("unexpected lines: %q", lines)
+	}
+
+	buf.Reset()
+	setLogFormat("json")
+	(&logWriter{out: &buf}).Log(logError, "failed", []logField{{"user", "alice"}, {"msg", "ignored"}})
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj["level"] != "error" || obj["msg"] != "failed" || obj["user"] != "alice" || obj["time"] == nil {
+		t.Errorf("unexpected JSON: %v", obj)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleLogLevelSignals lowers the log level on SIGUSR1 and raises it on
+// SIGUSR2.
+func handleLogLevelSignals(co *CommonClientOption) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range sig {
+			delta := 1
+			if s == syscall.SIGUSR1 {
+				delta = -1
+			}
+			co.Logger.Printf("[WARN] received %s, log level is %s", s, stepLogLevel(delta))
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package main
+
+// handleLogLevelSignals does nothing since Windows has no SIGUSR1 and SIGUSR2.
+func handleLogLevelSignals(co *CommonClientOption) {}
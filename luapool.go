@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type pooledLuaState struct {
+	L        *lua.LState
+	lastUsed time.Time
+}
+
+// luaStatePool keeps initialized Lua states for worker, cron and http
+// goroutines. Pooling is disabled if size is 0.
+type luaStatePool struct {
+	sync.Mutex
+	newState    func() *lua.LState
+	size        int
+	idleTimeout time.Duration
+	reset       string
+	logger      *log.Logger
+	states      []*pooledLuaState
+	stop        chan struct{}
+	generation  int
+	inUse       map[*lua.LState]int
+}
+
+var luaPool *luaStatePool
+
+func newLuaStatePool(newState func() *lua.LState) *luaStatePool {
+	return &luaStatePool{
+		newState:    newState,
+		size:        0,
+		idleTimeout: 5 * time.Minute,
+		states:      []*pooledLuaState{},
+		inUse:       make(map[*lua.LState]int),
+	}
+}
+
+func (p *luaStatePool) Configure(L *lua.LState, logger *log.Logger, tbl *lua.LTable) {
+	p.Lock()
+	defer p.Unlock()
+	if n, ok := getNumberField(L, tbl, "size"); ok {
+		p.size = int(n)
+	}
+	if n, ok := getNumberField(L, tbl, "idle"); ok {
+		p.idleTimeout = time.Duration(n * float64(time.Second))
+	}
+	if s, ok := getStringField(L, tbl, "reset"); ok {
+		p.reset = s
+	}
+	p.logger = logger
+}
+
+// Start fills the pool and starts evicting idle states.
+func (p *luaStatePool) Start() {
+	p.Lock()
+	defer p.Unlock()
+	if p.size <= 0 || p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	go func(size int, idleTimeout time.Duration, stop chan struct{}) {
+		for i := 0; i < size; i++ {
+			p.Put(p.create())
+		}
+		if idleTimeout <= 0 {
+			return
+		}
+		ticker := time.NewTicker(idleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.evict()
+			case <-stop:
+				return
+			}
+		}
+	}(p.size, p.idleTimeout, p.stop)
+}
+
+func (p *luaStatePool) Stop() {
+	p.Lock()
+	defer p.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	for _, s := range p.states {
+		s.L.Close()
+	}
+	p.states = p.states[:0]
+}
+
+func (p *luaStatePool) evict() {
+	p.Lock()
+	defer p.Unlock()
+	if p.idleTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	states := p.states[:0]
+	for _, s := range p.states {
+		if now.Sub(s.lastUsed) > p.idleTimeout {
+			s.L.Close()
+		} else {
+			states = append(states, s)
+		}
+	}
+	p.states = states
+}
+
+// Flush closes idle states and discards states in use when they are returned.
+// It is called after the config file is reloaded.
+func (p *luaStatePool) Flush() {
+	p.Lock()
+	defer p.Unlock()
+	p.generation++
+	for _, s := range p.states {
+		s.L.Close()
+	}
+	p.states = p.states[:0]
+}
+
+// Get returns an idle state or a new state if no idle states exist.
+func (p *luaStatePool) Get() *lua.LState {
+	p.Lock()
+	generation := p.generation
+	if n := len(p.states); n > 0 {
+		s := p.states[n-1]
+		p.states = p.states[:n-1]
+		p.inUse[s.L] = generation
+		p.Unlock()
+		return s.L
+	}
+	p.Unlock()
+	return p.create()
+}
+
+// create makes a new state tagged with the generation at its creation, so
+// that states created while the config file is reloaded are not pooled.
+func (p *luaStatePool) create() *lua.LState {
+	p.Lock()
+	generation := p.generation
+	p.Unlock()
+	L := p.newState()
+	p.Lock()
+	p.inUse[L] = generation
+	p.Unlock()
+	return L
+}
+
+// Put resets the state and returns it to the pool. The state will be closed
+// if the pool is full or the reset hook fails.
+func (p *luaStatePool) Put(L *lua.LState) {
+	databases.Rollback(L, true)
+	p.Lock()
+	reset := p.reset
+	generation, ok := p.inUse[L]
+	if !ok {
+		generation = p.generation
+	}
+	delete(p.inUse, L)
+	full := len(p.states) >= p.size || p.stop == nil || generation != p.generation
+	p.Unlock()
+	if full {
+		L.Close()
+		return
+	}
+	L.SetTop(0)
+	if len(reset) != 0 {
+		if fn, ok := L.GetGlobal(reset).(*lua.LFunction); ok {
+			L.Push(fn)
+			if err := L.PCall(0, 0, nil); err != nil {
+				p.logger.Printf("[ERROR] lua state reset: %s", err.Error())
+				L.Close()
+				return
+			}
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	if len(p.states) >= p.size || generation != p.generation {
+		L.Close()
+		return
+	}
+	p.states = append(p.states, &pooledLuaState{L, time.Now()})
+}
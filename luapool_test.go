@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestLuaStatePoolGeneration(t *testing.T) {
+	p := newLuaStatePool(func() *lua.LState { return lua.NewState() })
+	p.size = 2
+	p.stop = make(chan struct{})
+	defer p.Stop()
+
+	// states created by the filler before reloading are discarded
+	L := p.create()
+	p.Flush()
+	p.Put(L)
+	if len(p.states) != 0 {
+		t.Fatalf("states of old generations must not be pooled")
+	}
+	L = p.Get()
+	p.Flush()
+	p.Put(L)
+	if len(p.states) != 0 {
+		t.Fatalf("states in use while reloading must not be pooled")
+	}
+
+	p.Put(p.create())
+	L = p.Get()
+	p.Put(L)
+	if len(p.states) != 1 || p.states[0].L != L {
+		t.Errorf("expected the state to be pooled, got %d states", len(p.states))
+	}
+	if len(p.inUse) != 0 {
+		t.Errorf("returned states must not be tracked, got %d", len(p.inUse))
+	}
+}
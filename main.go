@@ -8,13 +8,13 @@ import (
 	"net/http"
 	"os"
 	"reflect"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/cihub/seelog"
 	"github.com/kohkimakimoto/gluafs"
 	"github.com/otm/gluash"
-	"github.com/robfig/cron"
 	"github.com/yuin/gluare"
 	"github.com/yuin/gopher-lua"
 	luajson "layeh.com/gopher-json"
@@ -47,6 +47,15 @@ function main()
     bot:say(e.target, tostring(tonumber(m[2]) + tonumber(m[3])))
   end)
 
+  bot:respond([[remind me in (\S+) (.+)]], function(m, e)
+    local id, err = golbot.schedule.after(m[2], "remind", {channel=e.target, user=e.from, message=m[3]})
+    if id == nil then
+      bot:say(e.target, err)
+    else
+      bot:say(e.target, "OK, I will remind you in " .. m[2])
+    end
+  end)
+
   bot:serve(function(msg)
     if msg.type == "say" then
       bot:say(msg.channel, msg.message)
@@ -59,6 +68,10 @@ function worker(msg)
   notifymain({type="say", channel=msg.channel, message="accepted"})
 end
 
+function remind(args)
+  notifymain({type="say", channel=args.channel, message=args.user .. ": " .. args.message})
+end
+
 function http(r)
   if r.method == "POST" and r.URL.path == "/say" then
     local msg = json.decode(r:readbody())
@@ -86,15 +99,19 @@ end
 `
 
 var luaMainChan chan lua.LValue
-var luaWorkerChan chan lua.LValue
 var logChan chan []interface{}
 
 var mainL *lua.LState
 var mutex sync.Mutex
 
 type CronEntry struct {
-	Spec     string
-	FuncName string
+	Spec          string
+	FuncName      string
+	Location      *time.Location
+	SkipIfRunning bool
+	Jitter        time.Duration
+	// overrides the cron timeout if not 0
+	Timeout time.Duration
 }
 
 type CommonClientOption struct {
@@ -105,49 +122,43 @@ type CommonClientOption struct {
 		CertFile string
 		KeyFile  string
 	}
-	Logger *log.Logger
-	Crons  []CronEntry
-}
-
-func newCommonClientOption(conf string) *CommonClientOption {
-	return &CommonClientOption{
-		ConfFile: conf,
-		HttpAddr: "",
-		Logger:   nil,
-	}
-}
-
-type cronJob struct {
-	jobName string
-	logger  *log.Logger
-	conf    string
-}
-
-func (cj *cronJob) Run() {
-	cj.logger.Printf("[INFO] cron '%s' started", cj.jobName)
-	L := newLuaState(cj.conf)
-	defer L.Close()
-	L.Push(L.GetGlobal(cj.jobName))
-	if err := L.PCall(0, 0, nil); err != nil {
-		cj.logger.Printf("[ERROR] cron '%s' : %s", cj.jobName, err.Error())
-	} else {
-		cj.logger.Printf("[INFO] cron '%s' successfully completed", cj.jobName)
+	HttpAuth    []*httpAuth
+	HttpMaxBody int64
+	Websocket   *websocketOption
+	Admin       *adminOption
+	Health      bool
+	Metrics     *metricsOption
+	Logger      *log.Logger
+	Reconnect   struct {
+		Min time.Duration
+		Max time.Duration
 	}
+	Outbox          *outbox
+	Crons           []CronEntry
+	WatchInterval   time.Duration
+	ShutdownTimeout time.Duration
+	CronsEndpoint   string
 }
 
-func startCrons(co *CommonClientOption) {
-	if co.Crons == nil {
-		return
-	}
-	c := cron.New()
-	c.ErrorLog = co.Logger
-	for _, entry := range co.Crons {
-		c.AddJob(entry.Spec, &cronJob{entry.FuncName, co.Logger, co.ConfFile})
+func newCommonClientOption(conf string) *CommonClientOption {
+	co := &CommonClientOption{
+		ConfFile:        conf,
+		HttpAddr:        "",
+		Logger:          newLogger(defaultLogWriter),
+		ShutdownTimeout: 10 * time.Second,
+		HttpMaxBody:     defaultMaxBodySize,
+		Health:          true,
+		Outbox:          newOutbox(),
 	}
-	c.Start()
+	co.Reconnect.Min = time.Second
+	co.Reconnect.Max = 5 * time.Minute
+	return co
 }
 
 func startLog(co *CommonClientOption) {
+	if ll, ok := getMainLogWriter().out.(*luaLogger); ok {
+		ll.Start()
+	}
 	go func() {
 		for {
 			select {
@@ -162,11 +173,12 @@ func startHttpServer(co *CommonClientOption) {
 	if co.HttpAddr != "" {
 		server := &http.Server{
 			Addr:    co.HttpAddr,
-			Handler: &httpHandler{co.Logger, co.ConfFile, false},
+			Handler: newHttpHandler(co, false),
 		}
-		co.Logger.Printf("http server started on %s", co.HttpAddr)
+		httpServers = append(httpServers, server)
+		co.Logger.Printf("[INFO] http server started on %s", co.HttpAddr)
 		go func() {
-			if err := server.ListenAndServe(); err != nil {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				co.Logger.Printf("[ERROR] http server:%s", err.Error())
 			}
 		}()
@@ -175,61 +187,77 @@ func startHttpServer(co *CommonClientOption) {
 	if co.Https.Addr != "" {
 		server := &http.Server{
 			Addr:    co.Https.Addr,
-			Handler: &httpHandler{co.Logger, co.ConfFile, true},
+			Handler: newHttpHandler(co, true),
 		}
-		co.Logger.Printf("https server started on %s(cert:%s, key:%s)", co.Https.Addr, co.Https.CertFile, co.Https.KeyFile)
+		httpServers = append(httpServers, server)
+		co.Logger.Printf("[INFO] https server started on %s(cert:%s, key:%s)", co.Https.Addr, co.Https.CertFile, co.Https.KeyFile)
 		go func() {
-			if err := server.ListenAndServeTLS(co.Https.CertFile, co.Https.KeyFile); err != nil {
+			if err := server.ListenAndServeTLS(co.Https.CertFile, co.Https.KeyFile); err != nil && err != http.ErrServerClosed {
 				co.Logger.Printf("[ERROR] https server: %s", err.Error())
 			}
 		}()
 	}
 }
 
+const luaLoggerQueueSize = 1000
+
+// luaLogger passes log lines to a function of the main Lua state. Lines are
+// queued, so loggers can be used while the global mutex is held and the
+// function can log messages. Lines are dropped if the queue is full.
 type luaLogger struct {
-	L  *lua.LState
-	fn *lua.LFunction
+	L     *lua.LState
+	fn    *lua.LFunction
+	lines chan string
+	once  sync.Once
 }
 
-func (ll *luaLogger) Write(p []byte) (int, error) {
-	pushN(ll.L, ll.fn, lua.LString(string(p)))
-	err := ll.L.PCall(1, 0, nil)
-	return len(p), err
+func newLuaLogger(L *lua.LState, fn *lua.LFunction) *luaLogger {
+	return &luaLogger{L: L, fn: fn, lines: make(chan string, luaLoggerQueueSize)}
 }
 
-type seelogLogger struct {
-	l seelog.LoggerInterface
+func (ll *luaLogger) Write(p []byte) (int, error) {
+	select {
+	case ll.lines <- string(p):
+	default:
+	}
+	return len(p), nil
 }
 
-func (sl *seelogLogger) Write(p []byte) (int, error) {
-	if len(p) > 0 && p[0] == '[' {
-		parts := strings.Split(string(p), " ")
-		switch parts[0] {
-		case "[TRACE]", "[trace]":
-			sl.l.Trace(strings.Join(parts[1:], " "))
-		case "[DEBUG]", "[debug]":
-			sl.l.Debug(strings.Join(parts[1:], " "))
-		case "[INFO]", "[info]":
-			sl.l.Info(strings.Join(parts[1:], " "))
-		case "[WARN]", "[warn]":
-			sl.l.Warn(strings.Join(parts[1:], " "))
-		case "[ERROR]", "[error]":
-			sl.l.Error(strings.Join(parts[1:], " "))
-		case "[CRITICAL]", "[critical]":
-			sl.l.Critical(strings.Join(parts[1:], " "))
-		default:
-			sl.l.Info(strings.Join(parts, " "))
-		}
-	} else {
-		sl.l.Info(string(p))
-	}
-	return 0, nil
+// Start calls the function for queued lines with the global mutex held. It is
+// called when the bot starts serving; after that, the main Lua state is used
+// only with the global mutex.
+func (ll *luaLogger) Start() {
+	ll.once.Do(func() {
+		go func() {
+			for line := range ll.lines {
+				mutex.Lock()
+				pushN(ll.L, ll.fn, lua.LString(line))
+				err := ll.L.PCall(1, 0, nil)
+				mutex.Unlock()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "log function: %s\n", err.Error())
+				}
+			}
+		}()
+	})
 }
 
 type httpHandler struct {
-	logger *log.Logger
-	conf   string
-	isTLS  bool
+	logger        *log.Logger
+	isTLS         bool
+	cronsEndpoint string
+	// auth for requests handled by the http/https function and routes
+	// without their own auth
+	auth      []*httpAuth
+	maxBody   int64
+	websocket *websocketOption
+	admin     *adminOption
+	health    bool
+	metrics   *metricsOption
+}
+
+func newHttpHandler(co *CommonClientOption, isTLS bool) *httpHandler {
+	return &httpHandler{co.Logger, isTLS, co.CronsEndpoint, co.HttpAuth, co.HttpMaxBody, co.Websocket, co.Admin, co.Health, co.Metrics}
 }
 
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -237,25 +265,120 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.isTLS {
 		protocol = "https"
 	}
+	// probes and scrapes are not logged
+	if h.health && serveHealth(w, r) {
+		return
+	}
+	if h.metrics != nil && r.URL.Path == h.metrics.Path {
+		if authorize(w, r, h.metrics.Auth) {
+			serveMetrics(w, r)
+		}
+		return
+	}
 	h.logger.Printf("[INFO] %s %s %s %s %s ", protocol, r.RemoteAddr, r.Method, r.RequestURI, r.Proto)
-	L := newLuaState(h.conf)
-	defer L.Close()
-	pushN(L, L.GetGlobal(protocol), luar.New(L, r))
-	err := L.PCall(1, 3, nil)
-	if err != nil {
-		h.logger.Printf("[ERROR] %s", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	handler := protocol
+	defer func(started time.Time) {
+		metricHttpDuration.Observe(time.Since(started).Seconds(), handler, metricHttpMethod(r.Method), strconv.Itoa(rec.Status()))
+	}(time.Now())
+	if len(h.cronsEndpoint) != 0 && r.URL.Path == h.cronsEndpoint {
+		handler = "crons"
+		if !authorize(w, r, h.auth) {
+			h.logger.Printf("[WARN] %s %s %s: authentication failed", protocol, r.RemoteAddr, r.URL.Path)
+			return
+		}
+		serveCronStatuses(w, r)
+		return
+	}
+	if h.websocket != nil && r.URL.Path == h.websocket.Path {
+		handler = "websocket"
+		// browsers can not set headers for websocket connections
+		if token := r.URL.Query().Get("access_token"); len(token) != 0 && len(r.Header.Get("Authorization")) == 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if !authorize(w, r, h.websocket.Auth) {
+			h.logger.Printf("[WARN] %s %s %s: authentication failed", protocol, r.RemoteAddr, r.URL.Path)
+			return
+		}
+		serveWebsocket(w, r, h.websocket, h.logger)
+		return
+	}
+	if h.admin != nil && h.admin.Match(r.URL.Path) {
+		handler = "admin"
+		if !authorize(w, r, h.admin.Auth) {
+			h.logger.Printf("[WARN] %s %s %s: authentication failed", protocol, r.RemoteAddr, r.URL.Path)
+			return
+		}
+		serveAdmin(w, r, h.admin, h.logger)
+		return
+	}
+	route, params, allowed := router.Match(r.Method, r.URL.Path)
+	if route == nil && len(allowed) != 0 {
+		methodNotAllowed(w, allowed)
+		return
+	}
+	auths, maxBody := h.auth, h.maxBody
+	if route != nil {
+		handler = route.Pattern
+		if route.auth != nil {
+			auths = route.auth
+		}
+		if route.maxBody != 0 {
+			maxBody = route.maxBody
+		}
+	}
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	if !authorize(w, r, auths) {
+		h.logger.Printf("[WARN] %s %s %s: authentication failed", protocol, r.RemoteAddr, r.URL.Path)
+		return
+	}
+	L := luaPool.Get()
+	defer luaPool.Put(L)
+	var fn lua.LValue = L.GetGlobal(protocol)
+	if route != nil {
+		if rfn := routeHandler(L, route); rfn != nil {
+			fn = rfn
+		}
+	}
+	if fn == lua.LNil {
+		http.NotFound(w, r)
+		return
+	}
+	res, ud := newHttpResponse(L, w, r)
+	top := L.GetTop()
+	pushN(L, fn, luar.New(L, r), routeParams(L, params), ud)
+	err := pcallWithTimeout(L, "http", 3, lua.MultRet)
+	if err == nil {
+		values := []lua.LValue{}
+		for i := top + 1; i <= L.GetTop(); i++ {
+			values = append(values, L.Get(i))
+		}
+		L.SetTop(top)
+		err = writeHttpResult(res, values)
+	}
+	if err == nil {
+		return
+	}
+	h.logger.Printf("[ERROR] %s", err.Error())
+	if res.written {
+		return
+	}
+	res.written = true
+	if _, ok := err.(*handlerTimeoutError); ok {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 	} else {
-		L.CheckTable(-2).ForEach(func(k, v lua.LValue) {
-			t := v.(*lua.LTable)
-			w.Header().Add(t.RawGetInt(1).String(), t.RawGetInt(2).String())
-		})
-		w.WriteHeader(int(L.CheckNumber(-3)))
-		fmt.Fprint(w, L.CheckString(-1))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
 
 func newLuaState(conf string) *lua.LState {
+	defer func(started time.Time) {
+		metricLuaStates.Add(1)
+		metricLuaStateDuration.Observe(time.Since(started).Seconds())
+	}(time.Now())
 	L := lua.NewState()
 	luar.GetConfig(L).FieldNames = func(s reflect.Type, f reflect.StructField) []string {
 		return []string{toSnakeCase(f.Name)}
@@ -269,20 +392,37 @@ func newLuaState(conf string) *lua.LState {
 	registerHipchatChatClientType(L)
 	registerNullChatClientType(L)
 	registerRocketChatClientType(L)
+	registerHttpResponseType(L)
+	registerMetricType(L)
 	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"newbot": func(L *lua.LState) int {
 			opt := L.OptTable(2, L.NewTable())
+			if reloading {
+				if L.CheckString(1) != mainAdapter {
+					L.RaiseError("chat type can not be changed from %s to %s without restarting", mainAdapter, L.ToString(1))
+				}
+				L.Push(reloadChatClient(L, opt))
+				return 1
+			}
 			co := newCommonClientOption(conf)
+			saveRestartOptions(L, opt)
+			lw := &logWriter{out: os.Stdout}
 			switch v := L.GetField(opt, "log").(type) {
 			case *lua.LFunction:
-				co.Logger = log.New(&luaLogger{L, v}, "", log.LstdFlags)
+				lw.out = newLuaLogger(L, v)
 			case *lua.LTable:
 				l, err := seelog.LoggerFromConfigAsString(luaToXml(v))
 				if err != nil {
 					L.RaiseError(err.Error())
 				}
-				co.Logger = log.New(&seelogLogger{l}, "", 0)
+				lw.seelog = l
 			}
+			if s, ok := getStringField(L, opt, "log_format"); ok && !setLogFormat(s) {
+				L.RaiseError("unknown log format: %s", s)
+			}
+			loadLogLevelOption(L, opt)
+			setMainLogWriter(lw)
+			co.Logger = newLogger(lw)
 			if s, ok := getStringField(L, opt, "http"); ok {
 				co.HttpAddr = s
 			}
@@ -297,13 +437,51 @@ func newLuaState(conf string) *lua.LState {
 					co.Https.KeyFile = s
 				}
 			}
+			co.HttpAuth = loadHttpAuths(L, L.GetField(opt, "http_auth"))
+			if n, ok := getNumberField(L, opt, "http_max_body"); ok {
+				co.HttpMaxBody = int64(n)
+			}
+			if tbl, ok := L.GetField(opt, "websocket").(*lua.LTable); ok {
+				co.Websocket = loadWebsocketOption(L, tbl)
+			}
+			if tbl, ok := L.GetField(opt, "admin").(*lua.LTable); ok {
+				co.Admin = loadAdminOption(L, tbl)
+			}
+			if v, ok := L.GetField(opt, "health").(lua.LBool); ok {
+				co.Health = bool(v)
+			}
+			co.Metrics = loadMetricsOption(L, L.GetField(opt, "metrics"))
+			if tbl, ok := L.GetField(opt, "reconnect").(*lua.LTable); ok {
+				if n, ok := getNumberField(L, tbl, "min"); ok {
+					co.Reconnect.Min = time.Duration(n * float64(time.Second))
+				}
+				if n, ok := getNumberField(L, tbl, "max"); ok {
+					co.Reconnect.Max = time.Duration(n * float64(time.Second))
+				}
+				if co.Reconnect.Min <= 0 || co.Reconnect.Max < co.Reconnect.Min {
+					L.RaiseError("reconnect: 'min' must be greater than 0 and less than 'max'")
+				}
+			}
 			if tbl, ok := L.GetField(opt, "crons").(*lua.LTable); ok {
 				co.Crons = []CronEntry{}
 				tbl.ForEach(func(key, value lua.LValue) {
-					entry := value.(*lua.LTable)
-					co.Crons = append(co.Crons, CronEntry{entry.RawGetInt(1).String(), entry.RawGetInt(2).String()})
+					co.Crons = append(co.Crons, loadCronEntry(L, value.(*lua.LTable)))
 				})
 			}
+			if s, ok := getStringField(L, opt, "crons_endpoint"); ok {
+				co.CronsEndpoint = s
+			}
+			switch v := L.GetField(opt, "watch").(type) {
+			case lua.LBool:
+				if v {
+					co.WatchInterval = 2 * time.Second
+				}
+			case lua.LNumber:
+				co.WatchInterval = time.Duration(float64(v) * float64(time.Second))
+			}
+			if n, ok := getNumberField(L, opt, "shutdown_timeout"); ok {
+				co.ShutdownTimeout = time.Duration(n * float64(time.Second))
+			}
 
 			switch L.CheckString(1) {
 			case "IRC":
@@ -319,6 +497,44 @@ func newLuaState(conf string) *lua.LState {
 			default:
 				L.RaiseError("unknown chat type: %s", L.ToString(1))
 			}
+			mutex.Lock()
+			mainAdapter = L.CheckString(1)
+			luaMain.L = L
+			mutex.Unlock()
+			logger := L.CheckUserData(-1).Value.(*luaChatClient).chatClient.Logger()
+			acl.SetLogger(logger)
+			co.Outbox.SetLogger(logger)
+			if tbl, ok := L.GetField(opt, "outbox").(*lua.LTable); ok {
+				loadOutboxOption(L, co.Outbox, tbl)
+			}
+			loadAclOption(L, L.GetField(opt, "acl"))
+			ratelimit, _ := L.GetField(opt, "ratelimit").(*lua.LTable)
+			loadRateLimitOption(L, logger, ratelimit)
+			if tbl, ok := L.GetField(opt, "databases").(*lua.LTable); ok {
+				loadDatabasesOption(L, tbl)
+			}
+			jobs.SetLogger(logger)
+			databases.SetLogger(logger)
+			scheduler.SetLogger(logger)
+			if s, ok := getStringField(L, opt, "schedule"); ok {
+				if err := scheduler.Open(s); err != nil {
+					L.RaiseError(err.Error())
+				}
+			}
+			if tbl, ok := L.GetField(opt, "jobs").(*lua.LTable); ok {
+				loadJobsOption(L, tbl)
+			}
+			if tbl, ok := L.GetField(opt, "timeout").(*lua.LTable); ok {
+				loadTimeoutOption(L, tbl)
+			}
+			if tbl, ok := L.GetField(opt, "luapool").(*lua.LTable); ok {
+				luaPool.Configure(L, logger, tbl)
+			}
+			if s, ok := getStringField(L, opt, "brain"); ok {
+				if err := brain.Open(s, logger); err != nil {
+					L.RaiseError(err.Error())
+				}
+			}
 			return 1
 		},
 		"newlogger": func(L *lua.LState) int {
@@ -326,29 +542,24 @@ func newLuaState(conf string) *lua.LState {
 			if err != nil {
 				L.RaiseError(err.Error())
 			}
-			L.Push(luar.New(L, log.New(&seelogLogger{logger}, "", 0)))
+			L.Push(luar.New(L, newLogger(&logWriter{seelog: logger})))
 			return 1
 		},
 	})
+	L.SetField(mod, "acl", L.SetFuncs(L.NewTable(), aclMod))
+	L.SetField(mod, "ratelimit", L.SetFuncs(L.NewTable(), rateLimitMod))
 	L.SetField(mod, "cmain", lua.LChannel(luaMainChan))
 	L.SetField(mod, "cworker", lua.LChannel(luaWorkerChan))
-	addLuaMethod(L, &http.Request{}, func(L *lua.LState, key string) bool {
-		if key == "readbody" || key == "ReadBody" {
-			L.Push(L.NewFunction(func(L *lua.LState) int {
-				r := L.CheckUserData(1).Value.(*http.Request)
-				b, err := ioutil.ReadAll(r.Body)
-				defer r.Body.Close()
-				if err != nil {
-					pushN(L, lua.LNil, lua.LString(err.Error()))
-					return 2
-				}
-				pushN(L, lua.LString(b))
-				return 1
-			}))
-			return true
-		}
-		return false
-	})
+	L.SetField(mod, "jobs", L.SetFuncs(L.NewTable(), jobsMod))
+	L.SetField(mod, "schedule", L.SetFuncs(L.NewTable(), scheduleMod))
+	L.SetField(mod, "crons", L.SetFuncs(L.NewTable(), cronsMod))
+	L.SetField(mod, "route", L.NewFunction(golbotRoute))
+	L.SetField(mod, "use", L.NewFunction(golbotUse))
+	L.SetField(mod, "webhook", L.SetFuncs(L.NewTable(), webhookMod))
+	L.SetField(mod, "alertmanager", L.SetFuncs(L.NewTable(), alertmanagerMod))
+	L.SetField(mod, "metrics", L.SetFuncs(L.NewTable(), metricsMod))
+	L.SetField(mod, "log", L.SetFuncs(L.NewTable(), logMod))
+	registerHttpRequestMethods(L)
 
 	L.PreloadModule("golbot", func(L *lua.LState) int {
 		L.Push(mod)
@@ -362,37 +573,24 @@ func newLuaState(conf string) *lua.LState {
 		L.Push(L.SetFuncs(L.NewTable(), requestsMod))
 		return 1
 	})
+	L.PreloadModule("db", dbLoader)
+	L.PreloadModule("brain", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), brainMod))
+		return 1
+	})
 	luajson.Preload(L)
 	L.PreloadModule("re", gluare.Loader)
 	L.PreloadModule("sh", gluash.Loader)
 	L.PreloadModule("fs", gluafs.Loader)
-	L.SetGlobal("goworker", L.NewFunction(func(L *lua.LState) int {
-		go func() {
-			L := newLuaState(conf)
-			pushN(L, L.GetGlobal("worker"), <-luaWorkerChan)
-			if err := L.PCall(1, 0, nil); err != nil {
-				logChan <- []interface{}{"[ERROR] %s", err.Error()}
-			}
-		}()
-		luaWorkerChan <- L.CheckAny(1)
-		return 0
-	}))
+	L.SetGlobal("goworker", L.NewFunction(goworker))
+	L.SetGlobal("requestmain", L.NewFunction(requestMain))
+	L.SetGlobal("respond", L.NewFunction(respondMain))
 
 	if err := L.DoString(`
       local golbot = require("golbot")
       local requests = require("requests")
       local json = require("json")
       notifymain  = function(msg) golbot.cmain:send(msg) end
-      requestmain = function(msg)
-        msg._result = channel.make()
-        golbot.cmain:send(msg)
-        return msg._result:receive()
-      end
-      respond = function(msg, value)
-        if msg and msg._result then
-          msg._result:send(value)
-        end
-      end
       requests.json = function(opt)
 	    local headers = opt.headers or {}
 		opt.headers = headers
@@ -477,7 +675,9 @@ Commands:
 
 	luaMainChan = make(chan lua.LValue)
 	luaWorkerChan = make(chan lua.LValue)
+	go forwardWorkerChan(luaWorkerChan)
 	logChan = make(chan []interface{})
+	luaPool = newLuaStatePool(func() *lua.LState { return newLuaState(optConfFile) })
 	mainL := newLuaState(optConfFile)
 	mainL.Push(mainL.GetGlobal("main"))
 	mainL.Call(0, 0)
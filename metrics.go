@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const metricTypeName = "golbotMetric"
+
+var defaultMetricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var metricLabelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// for histograms
+	count   uint64
+	buckets []uint64
+}
+
+// metricFamily is a metric with its series of label values.
+type metricFamily struct {
+	sync.Mutex
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if f.typ == "histogram" {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *metricFamily) Add(v float64, labelValues ...string) {
+	f.Lock()
+	defer f.Unlock()
+	f.get(labelValues).value += v
+}
+
+func (f *metricFamily) Set(v float64, labelValues ...string) {
+	f.Lock()
+	defer f.Unlock()
+	f.get(labelValues).value = v
+}
+
+func (f *metricFamily) Observe(v float64, labelValues ...string) {
+	f.Lock()
+	defer f.Unlock()
+	s := f.get(labelValues)
+	s.count++
+	s.value += v
+	for i, b := range f.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Reset removes all series. It is used for metrics collected at scrape time.
+func (f *metricFamily) Reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.series = map[string]*metricSeries{}
+}
+
+func (f *metricFamily) writeTo(w io.Writer) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+			continue
+		}
+		for i, b := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", formatMetricValue(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	if len(extraName) != 0 {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricRegistry holds metrics of golbot and scripts. Collectors update
+// metrics that are collected at scrape time.
+type metricRegistry struct {
+	sync.Mutex
+	families   map[string]*metricFamily
+	collectors []func()
+}
+
+var metrics = &metricRegistry{families: map[string]*metricFamily{}}
+
+// Register returns the metric of the name. It returns an error if the metric
+// is already registered with a different type or labels.
+func (m *metricRegistry) Register(name, help, typ string, labels []string, buckets []float64) (*metricFamily, error) {
+	if !metricNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("metrics: invalid metric name: %s", name)
+	}
+	for _, label := range labels {
+		if !metricLabelPattern.MatchString(label) || label == "le" {
+			return nil, fmt.Errorf("metrics: invalid label name: %s", label)
+		}
+	}
+	if typ == "histogram" {
+		if len(buckets) == 0 {
+			buckets = defaultMetricBuckets
+		}
+		buckets = append([]float64{}, buckets...)
+		sort.Float64s(buckets)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if f, ok := m.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			return nil, fmt.Errorf("metrics: %s is already registered as a %s with labels {%s}", name, f.typ, strings.Join(f.labels, ","))
+		}
+		return f, nil
+	}
+	f := &metricFamily{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: map[string]*metricSeries{}}
+	m.families[name] = f
+	return f, nil
+}
+
+func (m *metricRegistry) mustRegister(name, help, typ string, labels ...string) *metricFamily {
+	f, err := m.Register(name, help, typ, labels, nil)
+	if err != nil {
+		panic(err)
+	}
+	if len(labels) == 0 {
+		// exposes metrics without labels from the start
+		f.get(nil)
+	}
+	return f
+}
+
+func (m *metricRegistry) AddCollector(fn func()) {
+	m.Lock()
+	defer m.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+func (m *metricRegistry) Write(w io.Writer) {
+	m.Lock()
+	collectors := append([]func(){}, m.collectors...)
+	m.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	m.Lock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	families := m.families
+	m.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		families[name].writeTo(w)
+	}
+}
+
+var (
+	metricMessagesReceived = metrics.mustRegister("golbot_messages_received_total", "Number of received messages.", "counter", "adapter", "channel")
+	metricMessagesSent     = metrics.mustRegister("golbot_messages_sent_total", "Number of sent messages.", "counter", "adapter", "channel")
+	metricHandlerCalls     = metrics.mustRegister("golbot_handler_calls_total", "Number of Lua handler calls.", "counter", "kind")
+	metricHandlerErrors    = metrics.mustRegister("golbot_handler_errors_total", "Number of Lua handler errors.", "counter", "kind")
+	metricHandlerDuration  = metrics.mustRegister("golbot_handler_duration_seconds", "Execution time of Lua handlers.", "histogram", "kind")
+	metricLuaStates        = metrics.mustRegister("golbot_lua_states_created_total", "Number of created Lua states.", "counter")
+	metricLuaStateDuration = metrics.mustRegister("golbot_lua_state_creation_seconds", "Time to create a Lua state and load the config file.", "histogram")
+	metricHttpDuration     = metrics.mustRegister("golbot_http_request_duration_seconds", "Latency of http requests.", "histogram", "handler", "method", "code")
+	metricCronDuration     = metrics.mustRegister("golbot_cron_duration_seconds", "Execution time of cron jobs.", "histogram", "name")
+	metricCronErrors       = metrics.mustRegister("golbot_cron_errors_total", "Number of failed cron jobs.", "counter", "name")
+	metricReconnects       = metrics.mustRegister("golbot_reconnects_total", "Number of times the bot lost the connection to the chat server.", "counter")
+	metricConnected        = metrics.mustRegister("golbot_connected", "1 if the bot is connected to the chat server.", "gauge")
+	metricOutboxLength     = metrics.mustRegister("golbot_outbox_messages", "Number of queued outbound messages.", "gauge")
+	metricJobQueueDepth    = metrics.mustRegister("golbot_job_queue_depth", "Number of queued jobs.", "gauge", "queue")
+	metricJobsRunning      = metrics.mustRegister("golbot_jobs_running", "Number of running jobs.", "gauge", "queue")
+	metricRateLimitDropped = metrics.mustRegister("golbot_ratelimit_dropped_total", "Number of messages dropped by rate limits.", "counter", "scope")
+)
+
+func init() {
+	metrics.AddCollector(func() {
+		if client := getRunningClient(); client != nil {
+			outbox := client.CommonOption().Outbox
+			connected := 0.0
+			if outbox.Connected() {
+				connected = 1
+			}
+			metricConnected.Set(connected)
+			metricOutboxLength.Set(float64(outbox.Len()))
+		}
+		metricJobQueueDepth.Reset()
+		metricJobsRunning.Reset()
+		for name, stats := range jobs.Stats() {
+			metricJobQueueDepth.Set(float64(stats.Queued), name)
+			metricJobsRunning.Set(float64(stats.Running), name)
+		}
+		for scope, n := range rateLimiter.Dropped() {
+			metricRateLimitDropped.Set(float64(n), scope)
+		}
+	})
+}
+
+// adapterName returns the chat type of the client for metric labels.
+func adapterName(client ChatClient) string {
+	switch client.(type) {
+	case *ircChatClient:
+		return "IRC"
+	case *slackChatClient:
+		return "Slack"
+	case *hipchatChatClient:
+		return "Hipchat"
+	case *rocketChatClient:
+		return "Rocket"
+	}
+	return "Null"
+}
+
+// metricHttpMethod limits values of the method label.
+func metricHttpMethod(method string) string {
+	if httpMethods[method] && method != "*" {
+		return method
+	}
+	return "OTHER"
+}
+
+func observeHandler(kind string, started time.Time, err error) {
+	metricHandlerCalls.Add(1, kind)
+	metricHandlerDuration.Observe(time.Since(started).Seconds(), kind)
+	if err != nil {
+		metricHandlerErrors.Add(1, kind)
+	}
+}
+
+// metricsOption configures the metrics endpoint.
+type metricsOption struct {
+	Path string
+	Auth []*httpAuth
+}
+
+func loadMetricsOption(L *lua.LState, lv lua.LValue) *metricsOption {
+	switch v := lv.(type) {
+	case lua.LBool:
+		if v {
+			return &metricsOption{Path: "/metrics"}
+		}
+	case *lua.LTable:
+		o := &metricsOption{Path: "/metrics"}
+		if s, ok := getStringField(L, v, "path"); ok {
+			o.Path = s
+		}
+		o.Auth = loadHttpAuths(L, L.GetField(v, "auth"))
+		return o
+	}
+	return nil
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	metrics.Write(bw)
+	bw.Flush()
+}
+
+// statusRecorder records the status code of http responses.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// Status returns the status code. Responses without status codes are 200.
+func (sr *statusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := sr.ResponseWriter.(http.Hijacker); ok {
+		sr.status = http.StatusSwitchingProtocols
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("http: response does not implement http.Hijacker")
+}
+
+// metric objects for scripts
+
+func checkMetric(L *lua.LState) *metricFamily {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*metricFamily); ok {
+		return v
+	}
+	L.ArgError(1, "metric expected")
+	return nil
+}
+
+// metricLabelValues returns label values from a table of label names and values.
+func metricLabelValues(L *lua.LState, f *metricFamily, n int) []string {
+	tbl := L.OptTable(n, L.NewTable())
+	values := make([]string, len(f.labels))
+	for i, label := range f.labels {
+		lv := tbl.RawGetString(label)
+		if lv == lua.LNil {
+			L.ArgError(n, fmt.Sprintf("label '%s' is required", label))
+		}
+		values[i] = lv.String()
+	}
+	return values
+}
+
+var metricMethods = map[string]lua.LGFunction{
+	"inc": func(L *lua.LState) int {
+		f := checkMetric(L)
+		if f.typ == "histogram" {
+			L.RaiseError("metrics: %s is a histogram", f.name)
+		}
+		f.Add(1, metricLabelValues(L, f, 2)...)
+		return 0
+	},
+	"add": func(L *lua.LState) int {
+		f := checkMetric(L)
+		v := float64(L.CheckNumber(2))
+		if f.typ == "histogram" || (f.typ == "counter" && v < 0) {
+			L.RaiseError("metrics: can not add %v to the %s %s", v, f.typ, f.name)
+		}
+		f.Add(v, metricLabelValues(L, f, 3)...)
+		return 0
+	},
+	"set": func(L *lua.LState) int {
+		f := checkMetric(L)
+		if f.typ != "gauge" {
+			L.RaiseError("metrics: %s is not a gauge", f.name)
+		}
+		f.Set(float64(L.CheckNumber(2)), metricLabelValues(L, f, 3)...)
+		return 0
+	},
+	"observe": func(L *lua.LState) int {
+		f := checkMetric(L)
+		if f.typ != "histogram" {
+			L.RaiseError("metrics: %s is not a histogram", f.name)
+		}
+		f.Observe(float64(L.CheckNumber(2)), metricLabelValues(L, f, 3)...)
+		return 0
+	},
+}
+
+func registerMetricType(L *lua.LState) {
+	mt := L.NewTypeMetatable(metricTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), metricMethods))
+}
+
+func newLuaMetric(typ string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		name := L.CheckString(1)
+		help := L.OptString(2, name)
+		labels := []string{}
+		if tbl, ok := L.Get(3).(*lua.LTable); ok {
+			tbl.ForEach(func(_, v lua.LValue) { labels = append(labels, v.String()) })
+		}
+		buckets := []float64{}
+		if opt, ok := L.Get(4).(*lua.LTable); ok {
+			if tbl, ok := L.GetField(opt, "buckets").(*lua.LTable); ok {
+				tbl.ForEach(func(_, v lua.LValue) {
+					if n, ok := v.(lua.LNumber); ok {
+						buckets = append(buckets, float64(n))
+					}
+				})
+			}
+		}
+		f, err := metrics.Register(name, help, typ, labels, buckets)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		ud := L.NewUserData()
+		ud.Value = f
+		L.SetMetatable(ud, L.GetTypeMetatable(metricTypeName))
+		L.Push(ud)
+		return 1
+	}
+}
+
+var metricsMod = map[string]lua.LGFunction{
+	"counter":   newLuaMetric("counter"),
+	"gauge":     newLuaMetric("gauge"),
+	"histogram": newLuaMetric("histogram"),
+}
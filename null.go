@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"os"
 	"regexp"
 
 	"github.com/yuin/gopher-lua"
@@ -27,6 +26,7 @@ const nullDefaultConfigLua = `
 
 type nullChatClient struct {
 	commonOption *CommonClientOption
+	handlers     *chatHandlers
 }
 
 func (client *nullChatClient) Logger() *log.Logger {
@@ -37,7 +37,20 @@ func (client *nullChatClient) CommonOption() *CommonClientOption {
 	return client.commonOption
 }
 
-func (client *nullChatClient) Say(target, message string) {
+func (client *nullChatClient) Raw() interface{} {
+	return nil
+}
+
+func (client *nullChatClient) Handlers() *chatHandlers {
+	return client.handlers
+}
+
+func (client *nullChatClient) SetHandlers(handlers *chatHandlers) {
+	client.handlers = handlers
+}
+
+func (client *nullChatClient) Say(target, message string) error {
+	return nil
 }
 
 func (client *nullChatClient) On(L *lua.LState, action string, fn *lua.LFunction) {
@@ -50,12 +63,9 @@ func (client *nullChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
 	for {
 		select {
 		case msg := <-luaMainChan:
-			func() {
-				mutex.Lock()
-				defer mutex.Unlock()
-				pushN(L, fn, msg)
-				L.PCall(1, 0, nil)
-			}()
+			callServe(msg)
+		case <-shutdownChan:
+			return
 		}
 	}
 }
@@ -65,10 +75,8 @@ func registerNullChatClientType(L *lua.LState) {
 }
 
 func newNullChatClient(L *lua.LState, co *CommonClientOption, opt *lua.LTable) {
-	if co.Logger == nil {
-		co.Logger = log.New(os.Stdout, "", log.Lshortfile|log.LstdFlags)
-	}
-	chatClient := &nullChatClient{co}
+	co.Outbox.SetConnected(true)
+	chatClient := &nullChatClient{co, newChatHandlers()}
 	ud := L.NewUserData()
 	L.Push(newChatClient(L, nullChatClientTypeName, chatClient, ud))
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var errOutboxFull = errors.New("outbox is full")
+
+type outboundMessage struct {
+	Id       string    `json:"id"`
+	Target   string    `json:"target"`
+	Message  string    `json:"message"`
+	QueuedAt time.Time `json:"queued_at"`
+	Expires  time.Time `json:"expires,omitempty"`
+	// name of a global Lua function that receives the delivery result
+	Callback string `json:"callback,omitempty"`
+}
+
+func (m *outboundMessage) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// outbox buffers outgoing messages while the client is disconnected and
+// sends them when the client is connected again.
+type outbox struct {
+	sync.Mutex
+	messages  []*outboundMessage
+	connected bool
+	file      string
+	ttl       time.Duration
+	maxSize   int
+	// "drop_oldest" or "reject"
+	full   string
+	lastId int64
+	logger *log.Logger
+	// retries sending queued messages while the client is connected
+	retry   *time.Timer
+	backoff *backoff
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		messages: []*outboundMessage{},
+		ttl:      time.Hour,
+		maxSize:  1000,
+		full:     "drop_oldest",
+		backoff:  &backoff{min: time.Second, max: time.Minute},
+	}
+}
+
+func (o *outbox) logf(format string, args ...interface{}) {
+	if o.logger != nil {
+		o.logger.Printf(format, args...)
+	}
+}
+
+func (o *outbox) SetLogger(logger *log.Logger) {
+	o.Lock()
+	defer o.Unlock()
+	o.logger = logger
+}
+
+// Open loads messages that were not sent before golbot stopped.
+func (o *outbox) Open(file string) error {
+	o.Lock()
+	defer o.Unlock()
+	o.file = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &o.messages); err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return nil
+}
+
+func (o *outbox) save() {
+	if len(o.file) == 0 {
+		return
+	}
+	b, err := json.MarshalIndent(o.messages, "", "  ")
+	if err == nil {
+		tmp := o.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, o.file)
+		}
+	}
+	if err != nil {
+		o.logf("[ERROR] outbox: %s", err.Error())
+	}
+}
+
+func (o *outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.messages)
+}
+
+func (o *outbox) Connected() bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.connected
+}
+
+func (o *outbox) SetConnected(connected bool) {
+	o.Lock()
+	defer o.Unlock()
+	o.connected = connected
+}
+
+// Send sends the message immediately if the client is connected and no
+// messages are waiting. Otherwise the message is queued. The lock is not held
+// while sending so that slow servers do not block readers of the outbox.
+func (o *outbox) Send(client ChatClient, target, message, callback string) (string, error) {
+	o.Lock()
+	direct := o.connected && len(o.messages) == 0
+	o.Unlock()
+	var err error
+	if direct {
+		if err = client.Say(target, message); err == nil {
+			metricMessagesSent.Add(1, adapterName(client), target)
+			o.notify(&outboundMessage{Target: target, Message: message, Callback: callback}, true, "")
+			return "sent", nil
+		}
+	}
+	o.Lock()
+	defer o.Unlock()
+	if err != nil {
+		o.logf("[WARN] outbox: failed to send a message to %s, queued: %s", target, err.Error())
+		o.retryLater(client)
+	}
+	now := time.Now()
+	if len(o.messages) >= o.maxSize {
+		if o.full == "reject" {
+			return "", errOutboxFull
+		}
+		o.discard(o.messages[0], "dropped")
+		o.messages = o.messages[1:]
+	}
+	o.lastId++
+	m := &outboundMessage{
+		Id:       fmt.Sprintf("%d-%d", now.Unix(), o.lastId),
+		Target:   target,
+		Message:  message,
+		QueuedAt: now,
+		Callback: callback,
+	}
+	if o.ttl > 0 {
+		m.Expires = now.Add(o.ttl)
+	}
+	o.messages = append(o.messages, m)
+	o.save()
+	return "queued", nil
+}
+
+// Flush sends queued messages in order. It stops at the first failure, keeps
+// remaining messages and retries later.
+func (o *outbox) Flush(client ChatClient) {
+	o.Lock()
+	defer o.Unlock()
+	if !o.connected || len(o.messages) == 0 {
+		return
+	}
+	o.logf("[INFO] outbox: sending %d queued messages", len(o.messages))
+	now := time.Now()
+	i := 0
+	for ; i < len(o.messages); i++ {
+		m := o.messages[i]
+		if m.Expired(now) {
+			o.discard(m, "expired")
+			continue
+		}
+		if err := client.Say(m.Target, m.Message); err != nil {
+			o.logf("[ERROR] outbox: %s", err.Error())
+			o.retryLater(client)
+			break
+		}
+		metricMessagesSent.Add(1, adapterName(client), m.Target)
+		o.notify(m, true, "")
+	}
+	if i == len(o.messages) {
+		o.backoff.attempt = 0
+	}
+	o.messages = o.messages[i:]
+	o.save()
+}
+
+// retryLater flushes the outbox after a backoff delay unless a retry is
+// already scheduled. The lock must be held by the caller.
+func (o *outbox) retryLater(client ChatClient) {
+	if o.retry != nil {
+		return
+	}
+	d := o.backoff.Next()
+	o.logf("[INFO] outbox: retrying to send queued messages in %s", d)
+	o.retry = time.AfterFunc(d, func() {
+		o.Lock()
+		o.retry = nil
+		o.Unlock()
+		o.Flush(client)
+	})
+}
+
+func (o *outbox) discard(m *outboundMessage, reason string) {
+	o.logf("[WARN] outbox: discarded a message to %s: %s", m.Target, reason)
+	o.notify(m, false, reason)
+}
+
+// notify calls the callback of the message in a Lua state of the pool.
+func (o *outbox) notify(m *outboundMessage, ok bool, reason string) {
+	if len(m.Callback) == 0 {
+		return
+	}
+	go func() {
+		L := luaPool.Get()
+		defer luaPool.Put(L)
+		var err lua.LValue = lua.LNil
+		if !ok {
+			err = lua.LString(reason)
+		}
+		pushN(L, L.GetGlobal(m.Callback), lua.LBool(ok), err, lua.LString(m.Target), lua.LString(m.Message))
+		if err := pcallWithTimeout(L, "on", 4, 0); err != nil {
+			o.logf("[ERROR] outbox callback '%s': %s", m.Callback, err.Error())
+		}
+	}()
+}
+
+func loadOutboxOption(L *lua.LState, o *outbox, tbl *lua.LTable) {
+	if n, ok := getNumberField(L, tbl, "ttl"); ok {
+		o.ttl = time.Duration(n * float64(time.Second))
+	}
+	if n, ok := getNumberField(L, tbl, "max_size"); ok {
+		if n < 1 {
+			L.RaiseError("outbox: 'max_size' must be greater than 0")
+		}
+		o.maxSize = int(n)
+	}
+	if s, ok := getStringField(L, tbl, "full"); ok {
+		if s != "drop_oldest" && s != "reject" {
+			L.RaiseError("outbox: 'full' must be 'drop_oldest' or 'reject'")
+		}
+		o.full = s
+	}
+	if s, ok := getStringField(L, tbl, "file"); ok {
+		if err := o.Open(s); err != nil {
+			L.RaiseError(err.Error())
+		}
+	}
+}
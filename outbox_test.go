@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// testChatClient records sent messages and fails after failAfter messages.
+type testChatClient struct {
+	nullChatClient
+	sent      []string
+	failAfter int
+}
+
+func (client *testChatClient) Say(target, message string) error {
+	if client.failAfter >= 0 && len(client.sent) >= client.failAfter {
+		return errors.New("connection reset")
+	}
+	client.sent = append(client.sent, target+":"+message)
+	return nil
+}
+
+func stopRetry(o *outbox) {
+	o.Lock()
+	defer o.Unlock()
+	if o.retry != nil {
+		o.retry.Stop()
+		o.retry = nil
+	}
+}
+
+func TestOutboxFlush(t *testing.T) {
+	client := &testChatClient{failAfter: -1}
+	o := newOutbox()
+	for _, message := range []string{"a", "b", "c"} {
+		if status, err := o.Send(client, "#ops", message, ""); status != "queued" || err != nil {
+			t.Fatalf("expected the message to be queued, got %q %v", status, err)
+		}
+	}
+	o.Flush(client)
+	if len(client.sent) != 0 || o.Len() != 3 {
+		t.Fatalf("messages must not be sent while disconnected")
+	}
+
+	o.SetConnected(true)
+	o.Flush(client)
+	if !reflect.DeepEqual(client.sent, []string{"#ops:a", "#ops:b", "#ops:c"}) {
+		t.Errorf("unexpected messages: %v", client.sent)
+	}
+	if o.Len() != 0 {
+		t.Errorf("expected an empty outbox, got %d messages", o.Len())
+	}
+	if status, err := o.Send(client, "#ops", "d", ""); status != "sent" || err != nil {
+		t.Errorf("expected the message to be sent, got %q %v", status, err)
+	}
+}
+
+func TestOutboxFlushFailure(t *testing.T) {
+	client := &testChatClient{failAfter: 1}
+	o := newOutbox()
+	for _, message := range []string{"a", "b", "c"} {
+		o.Send(client, "#ops", message, "")
+	}
+	o.SetConnected(true)
+	o.Flush(client)
+	defer stopRetry(o)
+	if !reflect.DeepEqual(client.sent, []string{"#ops:a"}) {
+		t.Errorf("unexpected messages: %v", client.sent)
+	}
+	if o.Len() != 2 {
+		t.Errorf("expected 2 remaining messages, got %d", o.Len())
+	}
+	o.Lock()
+	retry := o.retry
+	o.Unlock()
+	if retry == nil {
+		t.Errorf("expected a retry to be scheduled")
+	}
+
+	// messages are queued while others are waiting
+	client.failAfter = -1
+	if status, _ := o.Send(client, "#ops", "d", ""); status != "queued" {
+		t.Errorf("expected the message to be queued, got %q", status)
+	}
+	stopRetry(o)
+	o.Flush(client)
+	if !reflect.DeepEqual(client.sent, []string{"#ops:a", "#ops:b", "#ops:c", "#ops:d"}) {
+		t.Errorf("messages must be sent in order, got %v", client.sent)
+	}
+	if o.backoff.attempt != 0 {
+		t.Errorf("expected the backoff to be reset, got %d", o.backoff.attempt)
+	}
+}
+
+func TestOutboxExpiredAndFull(t *testing.T) {
+	client := &testChatClient{failAfter: -1}
+	o := newOutbox()
+	o.maxSize = 2
+	o.Send(client, "#ops", "a", "")
+	o.Send(client, "#ops", "b", "")
+	o.Send(client, "#ops", "c", "")
+	o.Lock()
+	o.messages[0].Expires = time.Now().Add(-time.Second)
+	o.Unlock()
+	o.SetConnected(true)
+	o.Flush(client)
+	if !reflect.DeepEqual(client.sent, []string{"#ops:c"}) {
+		t.Errorf("oldest and expired messages must be discarded, got %v", client.sent)
+	}
+
+	o = newOutbox()
+	o.maxSize = 1
+	o.full = "reject"
+	o.Send(client, "#ops", "a", "")
+	if _, err := o.Send(client, "#ops", "b", ""); err != errOutboxFull {
+		t.Errorf("expected %v, got %v", errOutboxFull, err)
+	}
+}
+
+func TestOutboxCallback(t *testing.T) {
+	results := make(chan string, 2)
+	saved := luaPool
+	defer func() { luaPool = saved }()
+	luaPool = newLuaStatePool(func() *lua.LState {
+		L := lua.NewState()
+		L.SetGlobal("delivered", L.NewFunction(func(L *lua.LState) int {
+			results <- fmt.Sprintf("%v %v %s %s", L.ToBool(1), L.Get(2), L.ToString(3), L.ToString(4))
+			return 0
+		}))
+		return L
+	})
+	expect := func(expected string) {
+		select {
+		case result := <-results:
+			if result != expected {
+				t.Errorf("expected %q, got %q", expected, result)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the callback was not called")
+		}
+	}
+	client := &testChatClient{failAfter: -1}
+	o := newOutbox()
+	o.SetConnected(true)
+	if status, _ := o.Send(client, "#ops", "a", "delivered"); status != "sent" {
+		t.Fatalf("expected the message to be sent, got %q", status)
+	}
+	expect("true nil #ops a")
+	o.SetConnected(false)
+	o.Send(client, "#ops", "b", "delivered")
+	o.SetConnected(true)
+	o.Flush(client)
+	expect("true nil #ops b")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var rateLimitScopes = []string{"user", "channel", "command"}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimit struct {
+	// tokens per second
+	rate float64
+	// bucket size
+	burst float64
+}
+
+func (l rateLimit) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+}
+
+// respondRateLimiter limits respond callbacks with token buckets per user, per
+// channel and per command.
+type respondRateLimiter struct {
+	sync.Mutex
+	limits  map[string]rateLimit
+	buckets map[string]*tokenBucket
+	dropped map[string]int64
+	reply   string
+	logger  *log.Logger
+}
+
+var rateLimiter = &respondRateLimiter{
+	limits:  make(map[string]rateLimit),
+	buckets: make(map[string]*tokenBucket),
+	dropped: make(map[string]int64),
+}
+
+func newRateLimit(rate, burst float64) rateLimit {
+	if burst < 1 {
+		burst = 1
+	}
+	return rateLimit{rate, burst}
+}
+
+func (rl *respondRateLimiter) SetLimit(scope string, rate, burst float64) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.limits[scope] = newRateLimit(rate, burst)
+}
+
+// SetLimits replaces all limits.
+func (rl *respondRateLimiter) SetLimits(limits map[string]rateLimit) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.limits = limits
+}
+
+func (rl *respondRateLimiter) bucket(key string, limit rateLimit, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{limit.burst, now}
+		rl.buckets[key] = b
+	}
+	limit.refill(b, now)
+	return b
+}
+
+// prune removes full buckets, they are equivalent to missing ones.
+func (rl *respondRateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		limit := rl.limits[strings.SplitN(key, ":", 2)[0]]
+		limit.refill(b, now)
+		if b.tokens >= limit.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func rateLimitKeys(e *MessageEvent, command string) map[string]string {
+	user := e.UserId
+	if len(user) == 0 {
+		user = e.From
+	}
+	return map[string]string{"user": user, "channel": e.ChannelId, "command": command}
+}
+
+// Allow returns false if the user or the channel of the message ran out of
+// tokens. It does not consume tokens, respond filters do.
+func (rl *respondRateLimiter) Allow(e *MessageEvent) (string, bool) {
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	keys := rateLimitKeys(e, "")
+	for _, scope := range rateLimitScopes[:2] {
+		limit, ok := rl.limits[scope]
+		if !ok {
+			continue
+		}
+		if rl.bucket(scope+":"+keys[scope], limit, now).tokens < 1 {
+			rl.dropped[scope]++
+			return scope, false
+		}
+	}
+	return "", true
+}
+
+// Take consumes a token from every bucket the message belongs to. It returns
+// the scope that ran out of tokens if the message should be dropped.
+func (rl *respondRateLimiter) Take(e *MessageEvent, command string) (string, bool) {
+	rl.Lock()
+	defer rl.Unlock()
+	if len(rl.limits) == 0 {
+		return "", true
+	}
+	now := time.Now()
+	keys := rateLimitKeys(e, command)
+	buckets := []*tokenBucket{}
+	for _, scope := range rateLimitScopes {
+		limit, ok := rl.limits[scope]
+		if !ok {
+			continue
+		}
+		b := rl.bucket(scope+":"+keys[scope], limit, now)
+		if b.tokens < 1 {
+			rl.dropped[scope]++
+			return scope, false
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	if len(rl.buckets) > 10000 {
+		rl.prune(now)
+	}
+	return "", true
+}
+
+func (rl *respondRateLimiter) Dropped() map[string]int64 {
+	rl.Lock()
+	defer rl.Unlock()
+	dropped := make(map[string]int64, len(rl.dropped))
+	for k, v := range rl.dropped {
+		dropped[k] = v
+	}
+	return dropped
+}
+
+func (rl *respondRateLimiter) drop(client ChatClient, e *MessageEvent, scope string) {
+	rl.Lock()
+	logger, message := rl.logger, rl.reply
+	rl.Unlock()
+	if logger != nil {
+		logger.Printf("[DEBUG] ratelimit: dropped a message from %s(%s) in %s(%s) by %s limit", e.From, e.UserId, e.Target, e.ChannelId, scope)
+	}
+	if len(message) != 0 {
+		reply(client, e.Target, message)
+	}
+}
+
+func (rl *respondRateLimiter) Filter(command string) respondFilter {
+	return func(client ChatClient, e *MessageEvent) bool {
+		scope, ok := rl.Take(e, command)
+		if !ok {
+			rl.drop(client, e, scope)
+		}
+		return ok
+	}
+}
+
+// throttled drops messages to the bot from users and channels that ran out of
+// tokens. Adapters call it before taking the global mutex, so floods do not
+// wait for the mutex and are not matched against respond patterns.
+func throttled(client ChatClient, e *MessageEvent, mention *regexp.Regexp) bool {
+	if !mention.MatchString(e.Message) {
+		return false
+	}
+	scope, ok := rateLimiter.Allow(e)
+	if !ok {
+		rateLimiter.drop(client, e, scope)
+	}
+	return !ok
+}
+
+// loadRateLimitOption replaces limits with the option. Limits are removed
+// if tbl is nil.
+func loadRateLimitOption(L *lua.LState, logger *log.Logger, tbl *lua.LTable) {
+	limits := make(map[string]rateLimit)
+	reply := ""
+	if tbl != nil {
+		for _, scope := range rateLimitScopes {
+			if opt, ok := L.GetField(tbl, scope).(*lua.LTable); ok {
+				rate, rok := getNumberField(L, opt, "rate")
+				burst, bok := getNumberField(L, opt, "burst")
+				if !rok {
+					L.RaiseError("ratelimit: 'rate' is required for %s", scope)
+				}
+				if !bok {
+					burst = rate
+				}
+				limits[scope] = newRateLimit(rate, burst)
+			}
+		}
+		reply, _ = getStringField(L, tbl, "reply")
+	}
+	rateLimiter.SetLimits(limits)
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	rateLimiter.reply = reply
+	rateLimiter.logger = logger
+}
+
+var rateLimitMod = map[string]lua.LGFunction{
+	"set": func(L *lua.LState) int {
+		scope := L.CheckString(1)
+		switch scope {
+		case "user", "channel", "command":
+		default:
+			L.ArgError(1, "'user', 'channel' or 'command' expected")
+		}
+		rate := float64(L.CheckNumber(2))
+		rateLimiter.SetLimit(scope, rate, float64(L.OptNumber(3, lua.LNumber(rate))))
+		return 0
+	},
+	"dropped": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		for k, v := range rateLimiter.Dropped() {
+			tbl.RawSetString(k, lua.LNumber(v))
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
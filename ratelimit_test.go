@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func newTestRateLimiter() *respondRateLimiter {
+	return &respondRateLimiter{
+		limits:  make(map[string]rateLimit),
+		buckets: make(map[string]*tokenBucket),
+		dropped: make(map[string]int64),
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	now := time.Now()
+	limit := rateLimit{rate: 2, burst: 5}
+	cases := []struct {
+		tokens   float64
+		elapsed  time.Duration
+		expected float64
+	}{
+		{0, 0, 0},
+		{0, time.Second, 2},
+		{1, 500 * time.Millisecond, 2},
+		{4, 10 * time.Second, 5},
+	}
+	for _, c := range cases {
+		b := &tokenBucket{c.tokens, now.Add(-c.elapsed)}
+		limit.refill(b, now)
+		if b.tokens != c.expected {
+			t.Errorf("%v tokens after %s: expected %v, got %v", c.tokens, c.elapsed, c.expected, b.tokens)
+		}
+		if !b.last.Equal(now) {
+			t.Errorf("expected the last refill time to be updated")
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	rl := newTestRateLimiter()
+	alice := &MessageEvent{UserId: "alice", ChannelId: "C1"}
+	bob := &MessageEvent{UserId: "bob", ChannelId: "C1"}
+	if _, ok := rl.Take(alice, "deploy"); !ok {
+		t.Fatalf("messages must pass without limits")
+	}
+
+	rl.SetLimit("user", 0.001, 2)
+	rl.SetLimit("channel", 0.001, 3)
+	for i := 0; i < 2; i++ {
+		if _, ok := rl.Take(alice, "deploy"); !ok {
+			t.Fatalf("message %d must pass", i+1)
+		}
+	}
+	if scope, ok := rl.Take(alice, "deploy"); ok || scope != "user" {
+		t.Errorf("expected the user limit, got %q %v", scope, ok)
+	}
+	if _, ok := rl.Take(bob, "deploy"); !ok {
+		t.Errorf("users must have their own buckets")
+	}
+	// a dropped message does not consume tokens of other buckets
+	if scope, ok := rl.Take(bob, "deploy"); ok || scope != "channel" {
+		t.Errorf("expected the channel limit, got %q %v", scope, ok)
+	}
+	if tokens := rl.buckets["user:bob"].tokens; tokens < 1 {
+		t.Errorf("the user bucket of bob must still admit a message, got %v tokens", tokens)
+	}
+	dropped := rl.Dropped()
+	if dropped["user"] != 1 || dropped["channel"] != 1 {
+		t.Errorf("unexpected dropped counts: %v", dropped)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	rl := newTestRateLimiter()
+	rl.SetLimit("user", 1, 1)
+	now := time.Now()
+	rl.bucket("user:alice", rl.limits["user"], now).tokens = 0
+	rl.bucket("user:bob", rl.limits["user"], now)
+	rl.prune(now)
+	if _, ok := rl.buckets["user:bob"]; ok {
+		t.Errorf("full buckets must be removed")
+	}
+	if _, ok := rl.buckets["user:alice"]; !ok {
+		t.Errorf("buckets that are not full must be kept")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	saved := rateLimiter
+	defer func() { rateLimiter = saved }()
+	rateLimiter = newTestRateLimiter()
+	rateLimiter.SetLimit("user", 0.001, 1)
+	client := &testChatClient{failAfter: -1}
+	mention := regexp.MustCompile("^golbot\\s+")
+	alice := NewMessageEvent("", "alice", "room", "room", "golbot deploy", nil)
+	for i := 0; i < 2; i++ {
+		if throttled(client, alice, mention) {
+			t.Fatalf("checks before dispatching must not consume tokens")
+		}
+	}
+	rateLimiter.Take(alice, "deploy")
+	if !throttled(client, alice, mention) {
+		t.Errorf("expected the message to be throttled")
+	}
+	if throttled(client, NewMessageEvent("", "alice", "room", "room", "hello", nil), mention) {
+		t.Errorf("messages to others must not be throttled")
+	}
+	if _, ok := rateLimiter.Allow(NewMessageEvent("", "bob", "room", "room", "golbot deploy", nil)); !ok {
+		t.Errorf("users without ids must be limited by their names")
+	}
+	if dropped := rateLimiter.Dropped(); dropped["user"] != 1 {
+		t.Errorf("unexpected dropped counts: %v", dropped)
+	}
+}
+
+func TestLoadRateLimitOption(t *testing.T) {
+	saved := rateLimiter
+	defer func() { rateLimiter = saved }()
+	rateLimiter = newTestRateLimiter()
+	logger := log.New(ioutil.Discard, "", 0)
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`
+	  before = {user = {rate = 1, burst = 3}, channel = {rate = 2}, reply = "slow down"}
+	  after = {user = {rate = 0.5}}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	loadRateLimitOption(L, logger, L.GetGlobal("before").(*lua.LTable))
+	if limit := rateLimiter.limits["user"]; limit != (rateLimit{1, 3}) || rateLimiter.reply != "slow down" {
+		t.Errorf("unexpected limit: %v %q", limit, rateLimiter.reply)
+	}
+	loadRateLimitOption(L, logger, L.GetGlobal("after").(*lua.LTable))
+	if _, ok := rateLimiter.limits["channel"]; ok || len(rateLimiter.reply) != 0 {
+		t.Errorf("scopes removed from the option must be cleared")
+	}
+	if limit := rateLimiter.limits["user"]; limit != (rateLimit{0.5, 1}) {
+		t.Errorf("unexpected limit: %v", limit)
+	}
+	loadRateLimitOption(L, logger, nil)
+	if len(rateLimiter.limits) != 0 {
+		t.Errorf("limits must be removed, got %v", rateLimiter.limits)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+var errShuttingDown = errors.New("golbot is shutting down")
+
+// connectionEvent is passed to "connected" and "disconnected" callbacks.
+type connectionEvent struct {
+	Type   string
+	Reason string
+}
+
+// backoff calculates exponential delays with jitter.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func (b *backoff) Next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if v := b.min << b.attempt; v > 0 && v < b.max {
+			d = v
+			b.attempt++
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reconnect calls connect until it succeeds. It returns errShuttingDown if
+// golbot is shutting down while waiting.
+func reconnect(co *CommonClientOption, connect func() error) error {
+	b := &backoff{min: co.Reconnect.Min, max: co.Reconnect.Max}
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		d := b.Next()
+		co.Logger.Printf("[ERROR] failed to connect(attempt %d): %s, retrying in %s", attempt, err.Error(), d)
+		select {
+		case <-time.After(d):
+		case <-shutdownChan:
+			return errShuttingDown
+		}
+	}
+}
+
+// emitConnectionEvent calls "connected" or "disconnected" callbacks.
+// Queued messages are sent after "connected" callbacks.
+func emitConnectionEvent(client ChatClient, typ, reason string) {
+	outbox := client.CommonOption().Outbox
+	outbox.SetConnected(typ == "connected")
+	if typ == "disconnected" {
+		metricReconnects.Add(1)
+	}
+	liveEvents.Publish(&liveEvent{Type: typ, Reason: reason})
+	mutex.Lock()
+	if luaMain.L != nil {
+		client.Handlers().Apply(luaMain.L, client.Logger(), typ, &connectionEvent{typ, reason})
+	}
+	mutex.Unlock()
+	if typ == "connected" {
+		outbox.Flush(client)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		d := b.Next()
+		if d < max/2 || d > max {
+			t.Errorf("attempt %d: expected a delay between %s and %s, got %s", i+1, max/2, max, d)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	co := &CommonClientOption{Logger: log.New(ioutil.Discard, "", 0)}
+	co.Reconnect.Min = time.Millisecond
+	co.Reconnect.Max = 2 * time.Millisecond
+	attempts := 0
+	err := reconnect(co, func() error {
+		if attempts++; attempts < 3 {
+			return errors.New("refused")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d %v", attempts, err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"layeh.com/gopher-luar"
+)
+
+// reloading is true while the config file is reloaded. In this mode,
+// golbot.newbot returns the running client and bot:serve does not block.
+var reloading bool
+var reloadedServe *lua.LFunction
+var mainClient *luaChatClient
+var mainAdapter string
+
+// retiredStates are main states replaced by reloading. They are closed when
+// conversations started in them finish. The global mutex guards it.
+var retiredStates []*lua.LState
+
+func closeRetiredStates() {
+	states := []*lua.LState{}
+	for _, L := range retiredStates {
+		if conversations.Uses(L) {
+			states = append(states, L)
+			continue
+		}
+		databases.Rollback(L, true)
+		L.Close()
+	}
+	retiredStates = states
+}
+
+// restartOptions are options of golbot.newbot that are not applied by
+// reloading. Their values are kept to warn about changes.
+var restartOptions = []string{"log", "crons", "jobs", "outbox"}
+var restartOptionValues = map[string]string{}
+
+func saveRestartOptions(L *lua.LState, opt *lua.LTable) {
+	for _, name := range restartOptions {
+		restartOptionValues[name] = luaFingerprint(L.GetField(opt, name))
+	}
+}
+
+func warnRestartOptions(L *lua.LState, opt *lua.LTable, logger *log.Logger) {
+	for _, name := range restartOptions {
+		if luaFingerprint(L.GetField(opt, name)) != restartOptionValues[name] {
+			logger.Printf("[WARN] reload: '%s' option was changed, restart golbot to apply it", name)
+		}
+	}
+}
+
+// runningClient is the client of mainClient. Health checks and metrics read it
+// without the global mutex that long running handlers may hold.
+var runningClient struct {
+	sync.RWMutex
+	client ChatClient
+}
+
+func setRunningClient(client ChatClient) {
+	runningClient.Lock()
+	defer runningClient.Unlock()
+	runningClient.client = client
+}
+
+func getRunningClient() ChatClient {
+	runningClient.RLock()
+	defer runningClient.RUnlock()
+	return runningClient.client
+}
+
+// getRunningHandlers returns handlers of the running client or nil.
+func getRunningHandlers() *chatHandlers {
+	runningClient.RLock()
+	defer runningClient.RUnlock()
+	if runningClient.client == nil {
+		return nil
+	}
+	return runningClient.client.Handlers()
+}
+
+// setHandlers replaces handlers of the client. Readers of getRunningHandlers
+// wait for it.
+func setHandlers(client ChatClient, handlers *chatHandlers) {
+	runningClient.Lock()
+	defer runningClient.Unlock()
+	client.SetHandlers(handlers)
+}
+
+// reloadConfig loads the config file into a new Lua state and calls its main
+// function. Handlers of the running client are replaced without reconnecting.
+// Old handlers are kept if the new config file has errors.
+func reloadConfig() (err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if mainClient == nil {
+		return errors.New("bot is not running")
+	}
+	client := mainClient.chatClient
+	old := client.Handlers()
+	setHandlers(client, newChatHandlers())
+	reloading = true
+	reloadedServe = nil
+	router.Stage()
+	var L *lua.LState
+	// newState panics if the config file has errors
+	defer func() {
+		reloading = false
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			setHandlers(client, old)
+			if L != nil {
+				L.Close()
+			}
+		}
+		router.Commit(err == nil)
+	}()
+	L = luaPool.newState()
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("main"), NRet: 0, Protect: true}); err != nil {
+		return err
+	}
+	if reloadedServe == nil {
+		return errors.New("bot:serve was not called")
+	}
+	// The state that owns the log function is used until golbot exits.
+	if ll, ok := getMainLogWriter().out.(*luaLogger); !ok || ll.L != luaMain.L {
+		retiredStates = append(retiredStates, luaMain.L)
+	}
+	luaMain.L = L
+	luaMain.serve = reloadedServe
+	luaPool.Flush()
+	closeRetiredStates()
+	return nil
+}
+
+func reloadAndLog(co *CommonClientOption) {
+	if err := reloadConfig(); err != nil {
+		co.Logger.Printf("[ERROR] failed to reload %s: %s", co.ConfFile, err.Error())
+		return
+	}
+	co.Logger.Printf("[INFO] %s reloaded", co.ConfFile)
+}
+
+// startConfigWatcher reloads the config file on SIGHUP and, if the watch
+// option is set, when the config file is modified.
+func startConfigWatcher(co *CommonClientOption) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	var modTime time.Time
+	if co.WatchInterval > 0 {
+		if fi, err := os.Stat(co.ConfFile); err == nil {
+			modTime = fi.ModTime()
+		}
+		tick = time.Tick(co.WatchInterval)
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				reloadAndLog(co)
+			case <-tick:
+				fi, err := os.Stat(co.ConfFile)
+				if err != nil || !fi.ModTime().After(modTime) {
+					continue
+				}
+				modTime = fi.ModTime()
+				reloadAndLog(co)
+			}
+		}
+	}()
+}
+
+// reloadChatClient wraps the running client for a reloaded Lua state.
+// Options that require reconnecting are ignored.
+func reloadChatClient(L *lua.LState, opt *lua.LTable) *lua.LUserData {
+	client := mainClient.chatClient
+	var underlying *lua.LUserData
+	if raw := client.Raw(); raw != nil {
+		underlying = luar.New(L, raw).(*lua.LUserData)
+	} else {
+		underlying = L.NewUserData()
+	}
+	loadAclOption(L, L.GetField(opt, "acl"))
+	ratelimit, _ := L.GetField(opt, "ratelimit").(*lua.LTable)
+	loadRateLimitOption(L, client.Logger(), ratelimit)
+	loadLogLevelOption(L, opt)
+	if s, ok := getStringField(L, opt, "log_format"); ok && !setLogFormat(s) {
+		L.RaiseError("unknown log format: %s", s)
+	}
+	if tbl, ok := L.GetField(opt, "timeout").(*lua.LTable); ok {
+		loadTimeoutOption(L, tbl)
+	}
+	warnRestartOptions(L, opt, client.Logger())
+	return newChatClient(L, mainClient.typeName, client, underlying)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// setupReload makes a running client for reloadConfig and returns a function
+// that restores globals.
+func setupReload(t *testing.T, script string) (*nullChatClient, func()) {
+	conf := filepath.Join(t.TempDir(), "golbot.lua")
+	if err := ioutil.WriteFile(conf, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldPool, oldClient := luaPool, mainClient
+	client := &nullChatClient{handlers: newChatHandlers()}
+	luaPool = newLuaStatePool(func() *lua.LState { return newLuaState(conf) })
+	mainClient = &luaChatClient{typeName: nullChatClientTypeName, chatClient: client}
+	return client, func() {
+		luaPool, mainClient = oldPool, oldClient
+	}
+}
+
+func TestReloadBrokenScript(t *testing.T) {
+	for _, script := range []string{
+		`function main( end`,
+		`function main() error("broken") end`,
+		`function main() end`,
+	} {
+		client, restore := setupReload(t, script)
+		handlers := client.Handlers()
+		router.Add(newTestRoute("GET", "/kept"))
+		if err := reloadConfig(); err == nil {
+			t.Errorf("%s: expected an error", script)
+		}
+		if client.Handlers() != handlers {
+			t.Errorf("%s: old handlers must be kept", script)
+		}
+		if reloading || router.staged != nil {
+			t.Errorf("%s: reloading state must be cleared", script)
+		}
+		if route, _, _ := router.Match("GET", "/kept"); route == nil {
+			t.Errorf("%s: old routes must be kept", script)
+		}
+		restore()
+	}
+}
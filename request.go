@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const mainRequestKey = "_request"
+
+var errRequestTimeout = errors.New("timeout")
+
+type mainResponse struct {
+	value lua.LValue
+	err   error
+}
+
+// mainRequest is a request from other goroutines to the serve function.
+// It can be responded only once.
+type mainRequest struct {
+	result    chan mainResponse
+	responded int32
+}
+
+func (r *mainRequest) Respond(value lua.LValue, err error) bool {
+	if !atomic.CompareAndSwapInt32(&r.responded, 0, 1) {
+		return false
+	}
+	r.result <- mainResponse{value, err}
+	return true
+}
+
+func (r *mainRequest) Responded() bool {
+	return atomic.LoadInt32(&r.responded) != 0
+}
+
+func toMainRequest(msg lua.LValue) (*mainRequest, bool) {
+	tbl, ok := msg.(*lua.LTable)
+	if !ok {
+		return nil, false
+	}
+	ud, ok := tbl.RawGetString(mainRequestKey).(*lua.LUserData)
+	if !ok {
+		return nil, false
+	}
+	req, ok := ud.Value.(*mainRequest)
+	return req, ok
+}
+
+// requestMain sends the msg to the serve function and waits for the response.
+func requestMain(L *lua.LState) int {
+	msg := L.CheckTable(1)
+	opt := L.OptTable(2, L.NewTable())
+	var timeout <-chan time.Time
+	if n, ok := getNumberField(L, opt, "timeout"); ok && n > 0 {
+		timer := time.NewTimer(time.Duration(n * float64(time.Second)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var done <-chan struct{}
+	if ctx := L.Context(); ctx != nil {
+		done = ctx.Done()
+	}
+	req := &mainRequest{result: make(chan mainResponse, 1)}
+	ud := L.NewUserData()
+	ud.Value = req
+	msg.RawSetString(mainRequestKey, ud)
+
+	var res mainResponse
+	select {
+	case luaMainChan <- msg:
+		select {
+		case res = <-req.result:
+		case <-timeout:
+			res.err = errRequestTimeout
+		case <-done:
+			L.RaiseError(L.Context().Err().Error())
+		}
+	case <-timeout:
+		res.err = errRequestTimeout
+	case <-done:
+		L.RaiseError(L.Context().Err().Error())
+	}
+	if res.err != nil {
+		pushN(L, lua.LFalse, lua.LString(res.err.Error()))
+		return 2
+	}
+	pushN(L, lua.LTrue, res.value)
+	return 2
+}
+
+func respondMain(L *lua.LState) int {
+	if req, ok := toMainRequest(L.Get(1)); ok {
+		req.Respond(L.Get(2), nil)
+	}
+	return 0
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+const httpResponseTypeName = "httpResponse"
+
+// httpResponse is passed to http handlers as `w`. If a handler writes a
+// response through it, return values of the handler are ignored.
+type httpResponse struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	status  int
+	written bool
+	sse     bool
+}
+
+func (res *httpResponse) WriteHeader() {
+	if res.written {
+		return
+	}
+	res.written = true
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	res.w.WriteHeader(res.status)
+}
+
+func (res *httpResponse) Write(b []byte) error {
+	res.WriteHeader()
+	_, err := res.w.Write(b)
+	return err
+}
+
+func (res *httpResponse) Flush() {
+	if f, ok := res.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (res *httpResponse) Closed() bool {
+	select {
+	case <-res.r.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func newHttpResponse(L *lua.LState, w http.ResponseWriter, r *http.Request) (*httpResponse, *lua.LUserData) {
+	res := &httpResponse{w: w, r: r}
+	ud := L.NewUserData()
+	ud.Value = res
+	L.SetMetatable(ud, L.GetTypeMetatable(httpResponseTypeName))
+	return res, ud
+}
+
+func checkHttpResponse(L *lua.LState) *httpResponse {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*httpResponse); ok {
+		return v
+	}
+	L.ArgError(1, "http response expected")
+	return nil
+}
+
+func checkResponseNotWritten(L *lua.LState, res *httpResponse) {
+	if res.written {
+		L.RaiseError("http: headers have already been written")
+	}
+}
+
+func pushWriteResult(L *lua.LState, err error) int {
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+var httpResponseMethods = map[string]lua.LGFunction{
+	"header": func(L *lua.LState) int {
+		res := checkHttpResponse(L)
+		name := L.CheckString(2)
+		if L.GetTop() < 3 {
+			L.Push(lua.LString(res.w.Header().Get(name)))
+			return 1
+		}
+		checkResponseNotWritten(L, res)
+		res.w.Header().Set(name, L.CheckString(3))
+		return 0
+	},
+	"status": func(L *lua.LState) int {
+		res := checkHttpResponse(L)
+		checkResponseNotWritten(L, res)
+		res.status = checkHttpStatus(L, L.Get(2))
+		return 0
+	},
+	"write": func(L *lua.LState) int {
+		res := checkHttpResponse(L)
+		return pushWriteResult(L, res.Write([]byte(L.CheckString(2))))
+	},
+	"flush": func(L *lua.LState) int {
+		checkHttpResponse(L).Flush()
+		return 0
+	},
+	"json": func(L *lua.LState) int {
+		res := checkHttpResponse(L)
+		checkResponseNotWritten(L, res)
+		b, err := luajson.Encode(L.CheckAny(2))
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		if L.GetTop() > 2 {
+			res.status = checkHttpStatus(L, L.Get(3))
+		}
+		res.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		return pushWriteResult(L, res.Write(b))
+	},
+	"redirect": func(L *lua.LState) int {
+		res := checkHttpResponse(L)
+		checkResponseNotWritten(L, res)
+		status := http.StatusFound
+		if L.GetTop() > 2 {
+			status = checkHttpStatus(L, L.Get(3))
+		}
+		res.written = true
+		res.status = status
+		http.Redirect(res.w, res.r, L.CheckString(2), status)
+		return 0
+	},
+	"sse": func(L *lua.LState) int {
+		res := checkHttpResponse(L)
+		if !res.sse {
+			checkResponseNotWritten(L, res)
+			res.sse = true
+			res.w.Header().Set("Content-Type", "text/event-stream")
+			res.w.Header().Set("Cache-Control", "no-cache")
+			res.w.Header().Set("Connection", "keep-alive")
+		}
+		var buf strings.Builder
+		switch v := L.CheckAny(2).(type) {
+		case *lua.LTable:
+			for _, key := range []string{"id", "event", "retry"} {
+				if lv := v.RawGetString(key); lv != lua.LNil {
+					fmt.Fprintf(&buf, "%s: %s\n", key, lv.String())
+				}
+			}
+			data := v.RawGetString("data")
+			if tbl, ok := data.(*lua.LTable); ok {
+				b, err := luajson.Encode(tbl)
+				if err != nil {
+					L.ArgError(2, err.Error())
+				}
+				data = lua.LString(b)
+			}
+			if data != lua.LNil {
+				for _, line := range strings.Split(data.String(), "\n") {
+					fmt.Fprintf(&buf, "data: %s\n", line)
+				}
+			}
+		default:
+			for _, line := range strings.Split(L.CheckString(2), "\n") {
+				fmt.Fprintf(&buf, "data: %s\n", line)
+			}
+		}
+		buf.WriteString("\n")
+		err := res.Write([]byte(buf.String()))
+		res.Flush()
+		return pushWriteResult(L, err)
+	},
+	"closed": func(L *lua.LState) int {
+		L.Push(lua.LBool(checkHttpResponse(L).Closed()))
+		return 1
+	},
+}
+
+func registerHttpResponseType(L *lua.LState) {
+	mt := L.NewTypeMetatable(httpResponseTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), httpResponseMethods))
+}
+
+func checkHttpStatus(L *lua.LState, lv lua.LValue) int {
+	n, ok := lv.(lua.LNumber)
+	if !ok || n < 100 || n > 599 || float64(n) != float64(int(n)) {
+		L.RaiseError("http: status must be an integer between 100 and 599, got %s", describeLuaValue(lv))
+	}
+	return int(n)
+}
+
+func describeLuaValue(lv lua.LValue) string {
+	switch lv.(type) {
+	case lua.LNumber, lua.LString, lua.LBool:
+		return fmt.Sprintf("%s(%s)", lv.Type().String(), lv.String())
+	}
+	return lv.Type().String()
+}
+
+// writeHttpResult writes values returned by http handlers:
+// nothing or nil(204), or status, headers and body.
+func writeHttpResult(res *httpResponse, values []lua.LValue) error {
+	if res.written {
+		if len(values) != 0 && values[0] != lua.LNil {
+			return fmt.Errorf("http: the handler returned values after writing the response")
+		}
+		return nil
+	}
+	if len(values) == 0 || values[0] == lua.LNil {
+		if res.status == 0 {
+			res.status = http.StatusNoContent
+		}
+		res.WriteHeader()
+		return nil
+	}
+	status, ok := values[0].(lua.LNumber)
+	if !ok || status < 100 || status > 599 {
+		return fmt.Errorf("http: the 1st return value must be a status code, got %s", describeLuaValue(values[0]))
+	}
+	header := res.w.Header()
+	if len(values) > 1 {
+		switch v := values[1].(type) {
+		case *lua.LNilType:
+		case *lua.LTable:
+			var err error
+			v.ForEach(func(k, hv lua.LValue) {
+				switch pair := hv.(type) {
+				case *lua.LTable:
+					header.Add(pair.RawGetInt(1).String(), pair.RawGetInt(2).String())
+				case lua.LString, lua.LNumber:
+					if key, ok := k.(lua.LString); ok {
+						header.Set(string(key), pair.String())
+						return
+					}
+					err = fmt.Errorf("http: headers must be {{name, value}, ...} or {name = value, ...}")
+				default:
+					err = fmt.Errorf("http: headers must be {{name, value}, ...} or {name = value, ...}")
+				}
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("http: the 2nd return value must be a table of headers, got %s", describeLuaValue(values[1]))
+		}
+	}
+	var body []byte
+	if len(values) > 2 {
+		switch v := values[2].(type) {
+		case *lua.LNilType:
+		case lua.LString:
+			body = []byte(v)
+		default:
+			return fmt.Errorf("http: the 3rd return value must be a string body, got %s (use w:json to send tables)", describeLuaValue(values[2]))
+		}
+	}
+	res.status = int(status)
+	return res.Write(body)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// luaValues returns values returned by the Lua code.
+func luaValues(t *testing.T, L *lua.LState, code string) []lua.LValue {
+	top := L.GetTop()
+	if err := L.DoString(code); err != nil {
+		t.Fatal(err)
+	}
+	values := []lua.LValue{}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		values = append(values, L.Get(i))
+	}
+	L.SetTop(top)
+	return values
+}
+
+func TestWriteHttpResult(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	cases := []struct {
+		code   string
+		status int
+		header http.Header
+		body   string
+	}{
+		{`return`, 204, http.Header{}, ""},
+		{`return nil`, 204, http.Header{}, ""},
+		{`return 200`, 200, http.Header{}, ""},
+		{`return 404, nil, "not found"`, 404, http.Header{}, "not found"},
+		{`return 200, {["Content-Type"] = "text/plain"}, "ok"`, 200, http.Header{"Content-Type": {"text/plain"}}, "ok"},
+		{`return 200, {{"X-A", "1"}, {"X-A", "2"}}, "ok"`, 200, http.Header{"X-A": {"1", "2"}}, "ok"},
+		{`return 201, {["X-Id"] = 10}`, 201, http.Header{"X-Id": {"10"}}, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		res := &httpResponse{w: w, r: httptest.NewRequest("GET", "/", nil)}
+		if err := writeHttpResult(res, luaValues(t, L, c.code)); err != nil {
+			t.Errorf("%s: %s", c.code, err.Error())
+			continue
+		}
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.code, c.status, w.Code)
+		}
+		for name, values := range c.header {
+			if strings.Join(w.Header()[name], ",") != strings.Join(values, ",") {
+				t.Errorf("%s: expected %s: %v, got %v", c.code, name, values, w.Header()[name])
+			}
+		}
+		if w.Body.String() != c.body {
+			t.Errorf("%s: expected body %q, got %q", c.code, c.body, w.Body.String())
+		}
+	}
+}
+
+func TestWriteHttpResultErrors(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	cases := []struct {
+		code string
+		err  string
+	}{
+		{`return "200"`, "1st return value must be a status code"},
+		{`return 99`, "1st return value must be a status code"},
+		{`return 200, "text/plain"`, "2nd return value must be a table of headers"},
+		{`return 200, {true}`, "headers must be"},
+		{`return 200, {}, {ok = true}`, "3rd return value must be a string body"},
+	}
+	for _, c := range cases {
+		res := &httpResponse{w: httptest.NewRecorder(), r: httptest.NewRequest("GET", "/", nil)}
+		err := writeHttpResult(res, luaValues(t, L, c.code))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected %q, got %v", c.code, c.err, err)
+		}
+	}
+}
+
+func TestWriteHttpResultWritten(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	w := httptest.NewRecorder()
+	res := &httpResponse{w: w, r: httptest.NewRequest("GET", "/", nil)}
+	res.Write([]byte("streamed"))
+	if err := writeHttpResult(res, nil); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := writeHttpResult(res, luaValues(t, L, `return 200, {}, "ok"`)); err == nil {
+		t.Errorf("expected an error for values returned after writing the response")
+	}
+	if w.Code != 200 || w.Body.String() != "streamed" {
+		t.Errorf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+}
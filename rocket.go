@@ -6,9 +6,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/detached/gorocket/api"
 	"github.com/detached/gorocket/realtime"
@@ -98,34 +98,96 @@ func (c *rocketRestClient) Login(email, password string) error {
 }
 
 type rocketChatClient struct {
+	// guards realtimeClient that is replaced after reconnecting
+	sync.RWMutex
 	realtimeClient *realtime.Client
 	restClient     *rocketRestClient
 	commonOption   *CommonClientOption
 	logger         *log.Logger
-	callbacks      map[string][]*lua.LFunction
+	handlers       *chatHandlers
+	lastMsg        string
 	name           string
 	c2id           map[string]string
 	id2c           map[string]string
 	channels       []string
+	url            *url.URL
+	credentials    *api.UserCredentials
 }
 
-func (client *rocketChatClient) applyCallback(L *lua.LState, msg interface{}) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// connect creates a new realtime client and logs in.
+func (client *rocketChatClient) connect() error {
+	client.logger.Printf("[INFO] connect to %s", client.url.Host)
+	realtimeClient, err := realtime.NewClient(client.url.Hostname(), client.url.Port(), false)
+	if err != nil {
+		return err
+	}
+	client.logger.Printf("[INFO] login as %s(Realtime)", client.credentials.Name)
+	if err := realtimeClient.Login(client.credentials); err != nil {
+		realtimeClient.Close()
+		return err
+	}
+	client.Lock()
+	old := client.realtimeClient
+	client.realtimeClient = realtimeClient
+	client.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (client *rocketChatClient) conn() *realtime.Client {
+	client.RLock()
+	defer client.RUnlock()
+	return client.realtimeClient
+}
+
+// subscribe subscribes the channels and forwards messages to the aggregator.
+// The returned channel is closed when one of the message streams is closed.
+func (client *rocketChatClient) subscribe(aggregator chan api.Message) (chan struct{}, error) {
+	lost := make(chan struct{})
+	var once sync.Once
+	for _, channel := range client.channels {
+		client.logger.Printf("[INFO] join to %s", channel)
+		mc, err := client.conn().SubscribeToMessageStream(&api.Channel{Id: client.c2id[channel]})
+		if err != nil {
+			return nil, err
+		}
+		go func(c chan api.Message) {
+			for msg := range c {
+				aggregator <- msg
+			}
+			once.Do(func() { close(lost) })
+		}(mc)
+	}
+	return lost, nil
+}
+
+func (client *rocketChatClient) applyCallback(msg interface{}) {
 	typ := "message"
-	switch msg.(type) {
+	var me *MessageEvent
+	mention := regexp.MustCompile("@" + client.name + "\\s+")
+	switch e := msg.(type) {
 	case api.Message:
 		typ = "message"
-	}
-	v, ok := client.callbacks[typ]
-	if !ok {
-		return
-	}
-	for _, callback := range v {
-		pushN(L, callback, luar.New(L, msg))
-		if err := L.PCall(1, 0, nil); err != nil {
-			client.logger.Printf("[ERROR] %s", err.Error())
+		if client.lastMsg == e.Id {
+			return
 		}
+		client.lastMsg = e.Id
+		m := rocketMessage{e.Id, e.ChannelId, client.id2c[e.ChannelId], e.Text, e.Timestamp, e.User}
+		msg = m
+		if m.User.UserName != client.name {
+			me = NewMessageEvent(m.User.Id, m.User.UserName, m.ChannelId, m.Channel, m.Text, m)
+			if throttled(client, me, mention) {
+				return
+			}
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	client.handlers.Apply(luaMain.L, client.logger, typ, msg)
+	if me != nil {
+		dispatchMessage(luaMain.L, client, me, mention)
 	}
 }
 
@@ -137,91 +199,71 @@ func (client *rocketChatClient) CommonOption() *CommonClientOption {
 	return client.commonOption
 }
 
-func (client *rocketChatClient) Say(target, message string) {
-	client.realtimeClient.SendMessage(&api.Channel{Id: client.c2id[target]}, message)
+func (client *rocketChatClient) Raw() interface{} {
+	return client.conn()
+}
+
+func (client *rocketChatClient) Handlers() *chatHandlers {
+	return client.handlers
+}
+
+func (client *rocketChatClient) SetHandlers(handlers *chatHandlers) {
+	client.handlers = handlers
+}
+
+func (client *rocketChatClient) Channels() []string {
+	return client.channels
+}
+
+func (client *rocketChatClient) Say(target, message string) error {
+	_, err := client.conn().SendMessage(&api.Channel{Id: client.c2id[target]}, message)
+	return err
 }
 
 func (client *rocketChatClient) On(L *lua.LState, typ string, callback *lua.LFunction) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	v, ok := client.callbacks[typ]
-	if !ok {
-		v = []*lua.LFunction{}
-		client.callbacks[typ] = v
-	}
-	if typ == "message" {
-		lastMsg := ""
-		client.callbacks[typ] = append(v, L.NewFunction(func(L *lua.LState) int {
-			e := L.CheckUserData(1).Value.(api.Message)
-			if lastMsg == e.Id {
-				return 0
-			}
-			lastMsg = e.Id
-			rMsg := rocketMessage{e.Id, e.ChannelId, client.id2c[e.ChannelId], e.Text, e.Timestamp, e.User}
-			lrMsg := luar.New(L, rMsg)
-			pushN(L, callback, lrMsg)
-			if err := L.PCall(1, 0, nil); err != nil {
-				client.logger.Printf("[ERROR] %s", err.Error())
-			}
-			return 0
-		}))
-	} else {
-		client.callbacks[typ] = append(v, callback)
-	}
+	client.handlers.On(typ, callback)
 }
 
 func (client *rocketChatClient) Respond(L *lua.LState, pattern *regexp.Regexp, fn *lua.LFunction) {
-	client.On(L, "message", L.NewFunction(func(L *lua.LState) int {
-		e := L.CheckUserData(1).Value.(rocketMessage)
-		matches := pattern.FindAllStringSubmatch(e.Text, -1)
-		mentionMe, _ := regexp.MatchString("@"+client.name+"\\s+", e.Text)
-		if len(matches) > 0 && mentionMe {
-			to := client.id2c[e.ChannelId]
-			user := e.User.UserName
-			if user == client.name {
-				return 0
-			}
-			pushN(L, fn, luar.New(L, matches[0]), luar.New(L, NewMessageEvent(user, to, e.Text, e)))
-			if err := L.PCall(2, 0, nil); err != nil {
-				client.logger.Printf("[ERROR] %s", err.Error())
-			}
-		}
-		return 0
-	}))
+	client.handlers.Respond(pattern, fn)
 }
 
 func (client *rocketChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
-	realtimeClient := client.realtimeClient
 	aggregator := make(chan api.Message)
-	for _, channel := range client.channels {
-		client.commonOption.Logger.Printf("[INFO] join to %s", channel)
-		cid := client.c2id[channel]
-		mc, err := realtimeClient.SubscribeToMessageStream(&api.Channel{Id: cid})
-		if err != nil {
-			client.commonOption.Logger.Printf("[ERROR] %s", err.Error())
-			os.Exit(1)
+	var lost chan struct{}
+	resubscribe := func() error {
+		if err := client.connect(); err != nil {
+			return err
 		}
-		go func(c chan api.Message) {
-			for {
-				select {
-				case msg := <-c:
-					aggregator <- msg
-				}
-			}
-		}(mc)
+		var err error
+		lost, err = client.subscribe(aggregator)
+		return err
 	}
+	var err error
+	if lost, err = client.subscribe(aggregator); err != nil {
+		client.logger.Printf("[ERROR] %s", err.Error())
+		if reconnect(client.commonOption, resubscribe) != nil {
+			return
+		}
+	}
+	emitConnectionEvent(client, "connected", "")
 
 	for {
 		select {
 		case msg := <-aggregator:
-			client.applyCallback(L, msg)
+			client.applyCallback(msg)
+		case <-lost:
+			client.logger.Printf("[ERROR] disconnected: message stream closed")
+			emitConnectionEvent(client, "disconnected", "message stream closed")
+			if reconnect(client.commonOption, resubscribe) != nil {
+				return
+			}
+			emitConnectionEvent(client, "connected", "")
 		case msg := <-luaMainChan:
-			func() {
-				mutex.Lock()
-				defer mutex.Unlock()
-				pushN(L, fn, msg)
-				L.PCall(1, 0, nil)
-			}()
+			callServe(msg)
+		case <-shutdownChan:
+			client.conn().Close()
+			return
 		}
 	}
 }
@@ -240,68 +282,61 @@ func newRocketChatClient(L *lua.LState, co *CommonClientOption, opt *lua.LTable)
 		L.RaiseError("'url', 'name', 'email', 'password' are required")
 	}
 	u, err := url.Parse(surl)
-
-	abortIfError := func(err error) {
-		if err != nil {
-			co.Logger.Printf("[ERROR] %s", err.Error())
-			os.Exit(1)
-		}
-	}
-
-	abortIfError(err)
-
-	if co.Logger == nil {
-		co.Logger = log.New(os.Stdout, "", log.Lshortfile|log.LstdFlags)
+	if err != nil {
+		L.RaiseError(err.Error())
 	}
 
-	co.Logger.Printf("[INFO] login as %s(REST)", name)
 	restClient := newRocketRestClient(surl)
-	err = restClient.Login(email, password)
-	abortIfError(err)
-
-	co.Logger.Printf("[INFO] connect to %s", u.Host)
-	realtimeClient, err := realtime.NewClient(u.Hostname(), u.Port(), false)
-	abortIfError(err)
+	chatClient := &rocketChatClient{
+		restClient:   restClient,
+		commonOption: co,
+		logger:       co.Logger,
+		handlers:     newChatHandlers(),
+		name:         name,
+		c2id:         map[string]string{},
+		id2c:         map[string]string{},
+		channels:     strings.Split(channels, ","),
+		url:          u,
+		credentials:  &api.UserCredentials{Email: email, Name: name, Password: password},
+	}
 
-	co.Logger.Printf("[INFO] login as %s(Realtime)", name)
-	err = realtimeClient.Login(&api.UserCredentials{Email: email, Name: name, Password: password})
-	abortIfError(err)
+	err = reconnect(co, func() error {
+		co.Logger.Printf("[INFO] login as %s(REST)", name)
+		if err := restClient.Login(email, password); err != nil {
+			return err
+		}
+		return chatClient.connect()
+	})
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
 
-	c2id := map[string]string{}
 	co.Logger.Printf("[INFO] get available channel information")
 	allChannels, err := restClient.Call("/channels.list", httpRequestParam{Method: "GET"})
-	abortIfError(err)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
 
 	for _, channel := range asArray(allChannels["channels"]) {
 		m := asObject(channel)
 		co.Logger.Printf("[INFO] %s(id:%s)", m["name"].(string), m["_id"].(string))
-		c2id[m["name"].(string)] = m["_id"].(string)
+		chatClient.c2id[m["name"].(string)] = m["_id"].(string)
 	}
 
 	co.Logger.Printf("[INFO] get available group information")
 	allGroups, err := restClient.Call("/groups.list", httpRequestParam{Method: "GET"})
-	abortIfError(err)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
 
 	for _, group := range asArray(allGroups["groups"]) {
 		m := asObject(group)
 		co.Logger.Printf("[INFO] %s(id:%s)", m["name"].(string), m["_id"].(string))
-		c2id[m["name"].(string)] = m["_id"].(string)
+		chatClient.c2id[m["name"].(string)] = m["_id"].(string)
 	}
-	id2c := map[string]string{}
-	for k, v := range c2id {
-		id2c[v] = k
+	for k, v := range chatClient.c2id {
+		chatClient.id2c[v] = k
 	}
 
-	chatClient := &rocketChatClient{
-		realtimeClient: realtimeClient,
-		restClient:     restClient,
-		commonOption:   co,
-		logger:         co.Logger,
-		callbacks:      make(map[string][]*lua.LFunction),
-		name:           name,
-		c2id:           c2id,
-		id2c:           id2c,
-		channels:       strings.Split(channels, ","),
-	}
-	L.Push(newChatClient(L, rocketChatClientTypeName, chatClient, luar.New(L, chatClient.realtimeClient).(*lua.LUserData)))
+	L.Push(newChatClient(L, rocketChatClientTypeName, chatClient, luar.New(L, chatClient.conn()).(*lua.LUserData)))
 }
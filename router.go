@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const routesRegistryKey = "golbot.routes"
+const middlewaresRegistryKey = "golbot.middlewares"
+
+type httpRoute struct {
+	Method   string
+	Pattern  string
+	segments []string
+	// nil means the http_auth option, an empty list means no auth
+	auth []*httpAuth
+	// size limit of request bodies, 0 means the default limit
+	maxBody int64
+}
+
+func (r *httpRoute) Key() string {
+	return r.Method + " " + r.Pattern
+}
+
+// Match returns path parameters if the path matches the pattern.
+// ":name" matches a segment and "*name" matches the rest of the path.
+func (r *httpRoute) Match(path string) (map[string]string, bool) {
+	parts := splitPath(path)
+	params := map[string]string{}
+	for i, seg := range r.segments {
+		if strings.HasPrefix(seg, "*") {
+			params[seg[1:]] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, ":") {
+			params[seg[1:]] = parts[i]
+		} else if seg != parts[i] {
+			return nil, false
+		}
+	}
+	return params, len(parts) == len(r.segments)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// httpRouter holds routes shared by all Lua states. Handlers are kept in each
+// Lua state because functions can not be shared between states.
+type httpRouter struct {
+	sync.RWMutex
+	routes []*httpRoute
+	// routes registered while the config file is reloaded
+	staged []*httpRoute
+}
+
+var router = &httpRouter{routes: []*httpRoute{}}
+
+func (rt *httpRouter) Add(route *httpRoute) {
+	rt.Lock()
+	defer rt.Unlock()
+	routes := &rt.routes
+	if rt.staged != nil {
+		routes = &rt.staged
+	}
+	for _, r := range *routes {
+		if r.Key() == route.Key() {
+			return
+		}
+	}
+	*routes = append(*routes, route)
+}
+
+// Match returns the route and path parameters for the request. If only the
+// method does not match, allowed methods are returned.
+func (rt *httpRouter) Match(method, path string) (*httpRoute, map[string]string, []string) {
+	rt.RLock()
+	defer rt.RUnlock()
+	allowed := []string{}
+	for _, r := range rt.routes {
+		params, ok := r.Match(path)
+		if !ok {
+			continue
+		}
+		if r.Method == "*" || r.Method == method {
+			return r, params, nil
+		}
+		allowed = append(allowed, r.Method)
+	}
+	sort.Strings(allowed)
+	return nil, nil, allowed
+}
+
+// Stage starts collecting routes of the reloaded config file.
+func (rt *httpRouter) Stage() {
+	rt.Lock()
+	defer rt.Unlock()
+	rt.staged = []*httpRoute{}
+}
+
+// Commit replaces routes with staged routes if commit is true, otherwise
+// staged routes are discarded.
+func (rt *httpRouter) Commit(commit bool) {
+	rt.Lock()
+	defer rt.Unlock()
+	if commit {
+		rt.routes = rt.staged
+	}
+	rt.staged = nil
+}
+
+func registryTable(L *lua.LState, key string) *lua.LTable {
+	registry := L.Get(lua.RegistryIndex).(*lua.LTable)
+	tbl, ok := registry.RawGetString(key).(*lua.LTable)
+	if !ok {
+		tbl = L.NewTable()
+		registry.RawSetString(key, tbl)
+	}
+	return tbl
+}
+
+// routeHandler returns a function that calls middlewares and the handler of
+// the route. It returns nil if the route is not defined in the Lua state.
+func routeHandler(L *lua.LState, route *httpRoute) *lua.LFunction {
+	chain, ok := registryTable(L, routesRegistryKey).RawGetString(route.Key()).(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	fns := []lua.LValue{}
+	registryTable(L, middlewaresRegistryKey).ForEach(func(_, v lua.LValue) { fns = append(fns, v) })
+	chain.ForEach(func(_, v lua.LValue) { fns = append(fns, v) })
+	return chainFunc(L, fns, 0)
+}
+
+// chainFunc returns a function that calls fns[i] with (r, params, next, w).
+// The last function is the handler and is called with (r, params, w).
+func chainFunc(L *lua.LState, fns []lua.LValue, i int) *lua.LFunction {
+	if i == len(fns)-1 {
+		return fns[i].(*lua.LFunction)
+	}
+	next := chainFunc(L, fns, i+1)
+	return L.NewFunction(func(L *lua.LState) int {
+		r, params, w := L.Get(1), L.Get(2), L.Get(3)
+		nextFn := L.NewFunction(func(L *lua.LState) int {
+			top := L.GetTop()
+			pushN(L, next, r, params, w)
+			L.Call(3, lua.MultRet)
+			return L.GetTop() - top
+		})
+		top := L.GetTop()
+		pushN(L, fns[i], r, params, nextFn, w)
+		L.Call(4, lua.MultRet)
+		return L.GetTop() - top
+	})
+}
+
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "*": true,
+}
+
+func newHttpRoute(L *lua.LState, method, pattern string) *httpRoute {
+	method = strings.ToUpper(method)
+	if !httpMethods[method] {
+		L.ArgError(1, fmt.Sprintf("unknown method: %s", method))
+	}
+	route := &httpRoute{Method: method, Pattern: pattern, segments: splitPath(pattern)}
+	for i, seg := range route.segments {
+		if (strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*")) && len(seg) == 1 {
+			L.ArgError(2, "parameter name required")
+		}
+		if strings.HasPrefix(seg, "*") && i != len(route.segments)-1 {
+			L.ArgError(2, "'*' parameter must be the last segment")
+		}
+	}
+	return route
+}
+
+// addRoute adds the route and keeps its functions in the Lua state.
+func addRoute(L *lua.LState, route *httpRoute, chain *lua.LTable) {
+	registryTable(L, routesRegistryKey).RawSetString(route.Key(), chain)
+	router.Add(route)
+}
+
+// golbotRoute implements golbot.route(method, pattern, [middleware...,] handler [, opt]).
+func golbotRoute(L *lua.LState) int {
+	route := newHttpRoute(L, L.CheckString(1), L.CheckString(2))
+	last := L.GetTop()
+	if opt, ok := L.Get(last).(*lua.LTable); ok {
+		route.auth = loadHttpAuths(L, L.GetField(opt, "auth"))
+		if n, ok := getNumberField(L, opt, "max_body"); ok {
+			route.maxBody = int64(n)
+		}
+		last--
+	}
+	chain := L.NewTable()
+	for i := 3; i <= last; i++ {
+		chain.Append(L.CheckFunction(i))
+	}
+	if chain.Len() == 0 {
+		L.ArgError(3, "handler function expected")
+	}
+	addRoute(L, route, chain)
+	return 0
+}
+
+// golbotUse implements golbot.use(middleware).
+func golbotUse(L *lua.LState) int {
+	registryTable(L, middlewaresRegistryKey).Append(L.CheckFunction(1))
+	return 0
+}
+
+func routeParams(L *lua.LState, params map[string]string) *lua.LTable {
+	tbl := L.NewTable()
+	for k, v := range params {
+		tbl.RawSetString(k, lua.LString(v))
+	}
+	return tbl
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
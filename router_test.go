@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestRoute(method, pattern string) *httpRoute {
+	return &httpRoute{Method: method, Pattern: pattern, segments: splitPath(pattern)}
+}
+
+func TestHttpRouteMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		params  map[string]string
+		ok      bool
+	}{
+		{"/", "/", map[string]string{}, true},
+		{"/status", "/status", map[string]string{}, true},
+		{"/status", "/status/", map[string]string{}, true},
+		{"/status", "/statuses", nil, false},
+		{"/users/:id", "/users/10", map[string]string{"id": "10"}, true},
+		{"/users/:id", "/users", nil, false},
+		{"/users/:id", "/users/10/posts", nil, false},
+		{"/users/:id/posts/:post", "/users/10/posts/3", map[string]string{"id": "10", "post": "3"}, true},
+		{"/files/*path", "/files/a/b/c.txt", map[string]string{"path": "a/b/c.txt"}, true},
+		{"/files/*path", "/files", map[string]string{"path": ""}, true},
+		{"/files/*path", "/static/a", nil, false},
+	}
+	for _, c := range cases {
+		params, ok := newTestRoute("GET", c.pattern).Match(c.path)
+		if ok != c.ok {
+			t.Errorf("%s %s: expected %v, got %v", c.pattern, c.path, c.ok, ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(params, c.params) {
+			t.Errorf("%s %s: expected %v, got %v", c.pattern, c.path, c.params, params)
+		}
+	}
+}
+
+func TestHttpRouterMatch(t *testing.T) {
+	rt := &httpRouter{routes: []*httpRoute{}}
+	rt.Add(newTestRoute("GET", "/users/:id"))
+	rt.Add(newTestRoute("POST", "/users/:id"))
+	rt.Add(newTestRoute("*", "/any"))
+	// duplicated routes are ignored
+	rt.Add(newTestRoute("GET", "/users/:id"))
+	if len(rt.routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(rt.routes))
+	}
+
+	route, params, _ := rt.Match("POST", "/users/1")
+	if route == nil || route.Method != "POST" || params["id"] != "1" {
+		t.Errorf("unexpected match: %v %v", route, params)
+	}
+	if route, _, _ := rt.Match("DELETE", "/any"); route == nil {
+		t.Errorf("'*' must match any method")
+	}
+	route, _, allowed := rt.Match("DELETE", "/users/1")
+	if route != nil || !reflect.DeepEqual(allowed, []string{"GET", "POST"}) {
+		t.Errorf("expected allowed methods, got %v %v", route, allowed)
+	}
+	route, _, allowed = rt.Match("GET", "/missing")
+	if route != nil || len(allowed) != 0 {
+		t.Errorf("expected no routes, got %v %v", route, allowed)
+	}
+}
+
+func TestHttpRouterStage(t *testing.T) {
+	rt := &httpRouter{routes: []*httpRoute{}}
+	rt.Add(newTestRoute("GET", "/old"))
+
+	rt.Stage()
+	rt.Add(newTestRoute("GET", "/new"))
+	rt.Commit(false)
+	if route, _, _ := rt.Match("GET", "/old"); route == nil {
+		t.Errorf("routes must be kept if reloading fails")
+	}
+
+	rt.Stage()
+	rt.Add(newTestRoute("GET", "/new"))
+	rt.Commit(true)
+	if route, _, _ := rt.Match("GET", "/old"); route != nil {
+		t.Errorf("old routes must be removed")
+	}
+	if route, _, _ := rt.Match("GET", "/new"); route == nil {
+		t.Errorf("staged routes must be added")
+	}
+}
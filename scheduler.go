@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// maxCatchUpRuns limits runs of the "all" catch-up policy.
+const maxCatchUpRuns = 100
+
+type scheduledJob struct {
+	Id   string `json:"id"`
+	Spec string `json:"spec,omitempty"`
+	Func string `json:"func"`
+	// JSON encoded arguments
+	Args json.RawMessage `json:"args,omitempty"`
+	// "once", "skip" or "all"
+	CatchUp string    `json:"catch_up"`
+	Next    time.Time `json:"next"`
+	LastRun time.Time `json:"last_run,omitempty"`
+
+	schedule cron.Schedule
+	// runs missed while golbot was stopped, run by the "all" policy
+	missed int
+}
+
+func (j *scheduledJob) OneShot() bool {
+	return len(j.Spec) == 0
+}
+
+// jobScheduler runs global Lua functions at given times. Jobs can be added at
+// runtime and are saved to a file if the file is configured.
+type jobScheduler struct {
+	sync.Mutex
+	jobs   map[string]*scheduledJob
+	file   string
+	lastId int64
+	logger *log.Logger
+	stop   chan struct{}
+	// ids of running jobs. A job does not run again until it finishes.
+	running map[string]bool
+}
+
+var scheduler = &jobScheduler{jobs: make(map[string]*scheduledJob), running: make(map[string]bool)}
+
+func (s *jobScheduler) logf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
+
+func (s *jobScheduler) SetLogger(logger *log.Logger) {
+	s.Lock()
+	defer s.Unlock()
+	s.logger = logger
+}
+
+// Open loads jobs from the file and applies catch-up policies to runs missed
+// while golbot was stopped.
+func (s *jobScheduler) Open(file string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.file = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	jobs := []*scheduledJob{}
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+	now := time.Now()
+	for _, j := range jobs {
+		if !j.OneShot() {
+			if j.schedule, err = cron.Parse(j.Spec); err != nil {
+				return fmt.Errorf("%s: job '%s': %s", file, j.Id, err.Error())
+			}
+		}
+		s.jobs[j.Id] = j
+		if !j.Next.After(now) {
+			s.catchUp(j, now)
+		}
+	}
+	return nil
+}
+
+func (s *jobScheduler) catchUp(j *scheduledJob, now time.Time) {
+	switch j.CatchUp {
+	case "skip":
+		s.logf("[INFO] schedule: skipped missed runs of '%s'", j.Id)
+		if j.OneShot() {
+			delete(s.jobs, j.Id)
+		} else {
+			j.Next = j.schedule.Next(now)
+		}
+	case "all":
+		if j.OneShot() {
+			return
+		}
+		// missed runs are run one by one after the scheduler starts
+		j.missed = 0
+		for t := j.Next; !t.After(now) && j.missed < maxCatchUpRuns; t = j.schedule.Next(t) {
+			j.missed++
+		}
+		j.LastRun = now
+		j.Next = j.schedule.Next(now)
+	default:
+		// "once": the job runs at the next tick
+	}
+}
+
+func (s *jobScheduler) save() {
+	if len(s.file) == 0 {
+		return
+	}
+	jobs := make([]*scheduledJob, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Id < jobs[k].Id })
+	b, err := json.MarshalIndent(jobs, "", "  ")
+	if err == nil {
+		tmp := s.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, s.file)
+		}
+	}
+	if err != nil {
+		s.logf("[ERROR] schedule: %s", err.Error())
+	}
+}
+
+// Add adds a job. A job with the same id is replaced.
+func (s *jobScheduler) Add(j *scheduledJob) (string, error) {
+	if !j.OneShot() {
+		schedule, err := cron.Parse(j.Spec)
+		if err != nil {
+			return "", err
+		}
+		j.schedule = schedule
+		j.Next = schedule.Next(time.Now())
+	}
+	switch j.CatchUp {
+	case "":
+		j.CatchUp = "once"
+	case "once", "skip", "all":
+	default:
+		return "", fmt.Errorf("catch_up must be 'once', 'skip' or 'all'")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(j.Id) == 0 {
+		s.lastId++
+		j.Id = fmt.Sprintf("%d-%d", time.Now().Unix(), s.lastId)
+	}
+	s.jobs[j.Id] = j
+	s.save()
+	return j.Id, nil
+}
+
+func (s *jobScheduler) Remove(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return false
+	}
+	delete(s.jobs, id)
+	s.save()
+	return true
+}
+
+func (s *jobScheduler) List() []scheduledJob {
+	s.Lock()
+	defer s.Unlock()
+	jobs := make([]scheduledJob, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Next.Before(jobs[k].Next) })
+	return jobs
+}
+
+func (s *jobScheduler) Start() {
+	s.Lock()
+	defer s.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	missed := []scheduledJob{}
+	for _, j := range s.jobs {
+		if j.missed > 0 {
+			missed = append(missed, *j)
+			s.running[j.Id] = true
+			j.missed = 0
+		}
+	}
+	sort.Slice(missed, func(i, k int) bool { return missed[i].Id < missed[k].Id })
+	go s.runMissed(missed, s.stop)
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.tick(now)
+			case <-stop:
+				return
+			}
+		}
+	}(s.stop)
+}
+
+func (s *jobScheduler) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *jobScheduler) tick(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	changed := false
+	for id, j := range s.jobs {
+		if j.Next.After(now) {
+			continue
+		}
+		if s.running[id] {
+			s.logf("[WARN] schedule: '%s' is still running, skipped", id)
+		} else {
+			s.running[id] = true
+			go func(j scheduledJob) {
+				s.run(j.Id, j.Func, j.Args)
+				s.finish(j.Id)
+			}(*j)
+			j.LastRun = now
+		}
+		if j.OneShot() {
+			delete(s.jobs, id)
+		} else {
+			j.Next = j.schedule.Next(now)
+		}
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// runMissed runs missed runs of the jobs serially.
+func (s *jobScheduler) runMissed(jobs []scheduledJob, stop chan struct{}) {
+	for _, j := range jobs {
+		s.logf("[INFO] schedule: running %d missed runs of '%s'", j.missed, j.Id)
+		for i := 0; i < j.missed; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.run(j.Id, j.Func, j.Args)
+		}
+		s.finish(j.Id)
+	}
+}
+
+func (s *jobScheduler) finish(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.running, id)
+}
+
+func (s *jobScheduler) run(id, fn string, args json.RawMessage) {
+	L := luaPool.Get()
+	defer luaPool.Put(L)
+	L.Push(L.GetGlobal(fn))
+	if len(args) != 0 {
+		v, err := luajson.Decode(L, args)
+		if err != nil {
+			s.logf("[ERROR] schedule '%s': %s", id, err.Error())
+			L.Pop(1)
+			return
+		}
+		L.Push(v)
+	} else {
+		L.Push(lua.LNil)
+	}
+	L.Push(lua.LString(id))
+	if err := pcallWithTimeout(L, "cron", 2, 0); err != nil {
+		s.logf("[ERROR] schedule '%s': %s", id, err.Error())
+	}
+}
+
+func scheduleOption(L *lua.LState, n int, j *scheduledJob) {
+	j.Func = L.CheckString(n)
+	if lv := L.Get(n + 1); lv != lua.LNil {
+		b, err := luajson.Encode(lv)
+		if err != nil {
+			L.ArgError(n+1, err.Error())
+		}
+		j.Args = b
+	}
+	opt := L.OptTable(n+2, L.NewTable())
+	j.Id, _ = getStringField(L, opt, "id")
+	j.CatchUp, _ = getStringField(L, opt, "catch_up")
+}
+
+func scheduleAdd(L *lua.LState, j *scheduledJob) int {
+	id, err := scheduler.Add(j)
+	if err != nil {
+		pushN(L, lua.LNil, lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(id))
+	return 1
+}
+
+var scheduleMod = map[string]lua.LGFunction{
+	"every": func(L *lua.LState) int {
+		j := &scheduledJob{Spec: L.CheckString(1)}
+		scheduleOption(L, 2, j)
+		return scheduleAdd(L, j)
+	},
+	"at": func(L *lua.LState) int {
+		j := &scheduledJob{Next: time.Unix(int64(L.CheckNumber(1)), 0)}
+		scheduleOption(L, 2, j)
+		return scheduleAdd(L, j)
+	},
+	"after": func(L *lua.LState) int {
+		var d time.Duration
+		switch v := L.CheckAny(1).(type) {
+		case lua.LNumber:
+			d = time.Duration(float64(v) * float64(time.Second))
+		case lua.LString:
+			var err error
+			if d, err = time.ParseDuration(string(v)); err != nil {
+				pushN(L, lua.LNil, lua.LString(err.Error()))
+				return 2
+			}
+		default:
+			L.ArgError(1, "number or duration string expected")
+		}
+		j := &scheduledJob{Next: time.Now().Add(d)}
+		scheduleOption(L, 2, j)
+		return scheduleAdd(L, j)
+	},
+	"remove": func(L *lua.LState) int {
+		L.Push(lua.LBool(scheduler.Remove(L.CheckString(1))))
+		return 1
+	},
+	"list": func(L *lua.LState) int {
+		tbl := L.NewTable()
+		for _, j := range scheduler.List() {
+			jtbl := L.NewTable()
+			jtbl.RawSetString("id", lua.LString(j.Id))
+			if !j.OneShot() {
+				jtbl.RawSetString("spec", lua.LString(j.Spec))
+			}
+			jtbl.RawSetString("func", lua.LString(j.Func))
+			if len(j.Args) != 0 {
+				if v, err := luajson.Decode(L, j.Args); err == nil {
+					jtbl.RawSetString("args", v)
+				}
+			}
+			jtbl.RawSetString("catch_up", lua.LString(j.CatchUp))
+			jtbl.RawSetString("next", lua.LNumber(j.Next.Unix()))
+			if !j.LastRun.IsZero() {
+				jtbl.RawSetString("last_run", lua.LNumber(j.LastRun.Unix()))
+			}
+			tbl.Append(jtbl)
+		}
+		L.Push(tbl)
+		return 1
+	},
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cihub/seelog"
+	"github.com/yuin/gopher-lua"
+)
+
+// shutdownChan is closed when golbot is shutting down. Serve loops of chat
+// clients disconnect from the server and return.
+var shutdownChan = make(chan struct{})
+
+var httpServers []*http.Server
+
+// handleSignals shuts golbot down gracefully on SIGINT or SIGTERM.
+// The second signal exits immediately.
+func handleSignals(co *CommonClientOption) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		co.Logger.Printf("[INFO] received %s, shutting down", s)
+		go func() {
+			<-sig
+			co.Logger.Printf("[WARN] received %s again, exit immediately", s)
+			flushLogs()
+			os.Exit(1)
+		}()
+		shutdown(co)
+	}()
+}
+
+func shutdown(co *CommonClientOption) {
+	ctx, cancel := context.WithTimeout(context.Background(), co.ShutdownTimeout)
+	defer cancel()
+	liveEvents.Close()
+	for _, server := range httpServers {
+		if err := server.Shutdown(ctx); err != nil {
+			co.Logger.Printf("[ERROR] http server %s: %s", server.Addr, err.Error())
+		}
+	}
+	if cronRunner != nil {
+		cronRunner.Stop()
+	}
+	scheduler.Stop()
+	if !jobs.Drain(ctx) {
+		co.Logger.Printf("[WARN] jobs did not finish in %s, canceled", co.ShutdownTimeout)
+	}
+
+	mutex.Lock()
+	callShutdownHook(co, luaMain.L)
+	mutex.Unlock()
+	close(shutdownChan)
+}
+
+// callShutdownHook calls the shutdown function of golbot.lua. It is stopped
+// after the shutdown timeout.
+func callShutdownHook(co *CommonClientOption, L *lua.LState) {
+	fn, ok := L.GetGlobal("shutdown").(*lua.LFunction)
+	if !ok {
+		return
+	}
+	L.Push(fn)
+	err := withDeadline(L, "shutdown", co.ShutdownTimeout, func() error {
+		return L.PCall(0, 0, nil)
+	})
+	databases.Rollback(L, false)
+	if err != nil {
+		co.Logger.Printf("[ERROR] shutdown: %s", err.Error())
+	}
+}
+
+// cleanup releases resources shared by Lua states after the chat client stopped.
+func cleanup(co *CommonClientOption) {
+	luaPool.Stop()
+	databases.CloseAll()
+	if err := brain.Close(); err != nil {
+		co.Logger.Printf("[ERROR] brain: %s", err.Error())
+	}
+	co.Logger.Printf("[INFO] golbot stopped")
+	flushLogs()
+}
+
+// flushLogs writes messages buffered by seelog loggers.
+func flushLogs() {
+	getMainLogWriter().Flush()
+	seelog.Flush()
+}
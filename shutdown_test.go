@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestCallShutdownHook(t *testing.T) {
+	var buf bytes.Buffer
+	co := &CommonClientOption{Logger: log.New(&buf, "", 0), ShutdownTimeout: 100 * time.Millisecond}
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`function shutdown() while true do end end`); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		callShutdownHook(co, L)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the shutdown hook must be stopped after the timeout")
+	}
+	if !strings.Contains(buf.String(), "timed out") {
+		t.Errorf("expected a timeout error, got %q", buf.String())
+	}
+}
+
+func TestJobsDrainCanceled(t *testing.T) {
+	m := &jobManager{queues: make(map[string]*jobQueue), jobs: make(map[int64]*job)}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.jobs[1] = &job{id: 1, ctx: ctx, cancel: cancel}
+	m.wg.Add(1)
+	stopped := false
+	go func() {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		stopped = true
+		m.wg.Done()
+	}()
+	expired, cancelDrain := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelDrain()
+	if m.Drain(expired) {
+		t.Errorf("expected jobs to be canceled")
+	}
+	if !stopped {
+		t.Errorf("Drain must wait for canceled jobs")
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"log"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nlopes/slack"
@@ -50,17 +50,22 @@ type slackChatClient struct {
 	logger         *log.Logger
 	userId         string
 	startedAt      float64
-	callbacks      map[string][]*lua.LFunction
+	handlers       *chatHandlers
 	userId2Name    map[string]string
 	userName2Id    map[string]string
 	channelId2Name map[string]string
 	channelName2Id map[string]string
+	// guards the maps above. They are written by the Serve goroutine and read
+	// by goroutines that send messages.
+	names sync.RWMutex
 }
 
 func (client *slackChatClient) toSlackChannelId(v string) string {
 	if ok, _ := regexp.MatchString(`[CU][0-9].*`, v); ok {
 		return v
 	}
+	client.names.RLock()
+	defer client.names.RUnlock()
 	if strings.HasPrefix(v, "#") {
 		if v, ok := client.channelName2Id[v[1:]]; ok {
 			return v
@@ -72,24 +77,34 @@ func (client *slackChatClient) toSlackChannelId(v string) string {
 	return v
 }
 
-func (client *slackChatClient) applyCallback(L *lua.LState, msg *slack.RTMEvent) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	v, ok := client.callbacks[msg.Type]
-	if !ok {
-		return
-	}
-	for _, callback := range v {
-		if e, ok := msg.Data.(*slack.MessageEvent); ok {
-			f, _ := strconv.ParseFloat(e.Timestamp, 64)
-			if (f - client.startedAt) < 3 {
+func (client *slackChatClient) applyCallback(msg *slack.RTMEvent) {
+	e, isMessage := msg.Data.(*slack.MessageEvent)
+	var me *MessageEvent
+	mention := regexp.MustCompile("<@" + client.userId + "[^>]*>")
+	if isMessage {
+		f, _ := strconv.ParseFloat(e.Timestamp, 64)
+		if (f - client.startedAt) < 3 {
+			return
+		}
+		// names are updated by Serve that calls applyCallback
+		if e.SubType == "me_message" || len(e.SubType) == 0 {
+			me = NewMessageEvent(e.User, client.userId2Name[e.User], e.Channel, "#"+client.channelId2Name[e.Channel], e.Text, e)
+			if throttled(client, me, mention) {
 				return
 			}
 		}
-		pushN(L, callback, luar.New(L, msg.Data))
-		if err := L.PCall(1, 0, nil); err != nil {
-			client.logger.Printf("[Error] %s", err.Error())
-		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// connection events are passed to callbacks by emitConnectionEvent
+	if msg.Type != "connected" && msg.Type != "disconnected" {
+		client.handlers.Apply(luaMain.L, client.logger, msg.Type, msg.Data)
+	}
+	if isMessage && e.SubType == "channel_join" {
+		liveEvents.Publish(&liveEvent{Type: "join", Channel: "#" + client.channelId2Name[e.Channel], ChannelId: e.Channel, User: client.userId2Name[e.User], UserId: e.User})
+	}
+	if me != nil {
+		dispatchMessage(luaMain.L, client, me, mention)
 	}
 }
 
@@ -101,36 +116,54 @@ func (client *slackChatClient) CommonOption() *CommonClientOption {
 	return client.commonOption
 }
 
-func (client *slackChatClient) Say(target, message string) {
+func (client *slackChatClient) Raw() interface{} {
+	return client.rtm
+}
+
+func (client *slackChatClient) Handlers() *chatHandlers {
+	return client.handlers
+}
+
+func (client *slackChatClient) SetHandlers(handlers *chatHandlers) {
+	client.handlers = handlers
+}
+
+func (client *slackChatClient) Channels() []string {
+	client.names.RLock()
+	defer client.names.RUnlock()
+	channels := []string{}
+	for _, name := range client.channelId2Name {
+		channels = append(channels, "#"+name)
+	}
+	return channels
+}
+
+func (client *slackChatClient) Say(target, message string) error {
 	client.rtm.SendMessage(client.rtm.NewOutgoingMessage(message, client.toSlackChannelId(target)))
+	return nil
+}
+
+func (client *slackChatClient) PostMessage(target, message string) (string, error) {
+	_, ts, err := client.slackobj.PostMessage(client.toSlackChannelId(target), message, slack.PostMessageParameters{AsUser: true})
+	return ts, err
+}
+
+func (client *slackChatClient) ReplyInThread(target, thread, message string) error {
+	_, _, err := client.slackobj.PostMessage(client.toSlackChannelId(target), message, slack.PostMessageParameters{AsUser: true, ThreadTimestamp: thread})
+	return err
+}
+
+func (client *slackChatClient) UpdateMessage(target, id, message string) error {
+	_, _, _, err := client.slackobj.UpdateMessage(client.toSlackChannelId(target), id, message)
+	return err
 }
 
 func (client *slackChatClient) On(L *lua.LState, typ string, callback *lua.LFunction) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	v, ok := client.callbacks[typ]
-	if !ok {
-		v = []*lua.LFunction{}
-		client.callbacks[typ] = v
-	}
-	client.callbacks[typ] = append(v, callback)
+	client.handlers.On(typ, callback)
 }
 
 func (client *slackChatClient) Respond(L *lua.LState, pattern *regexp.Regexp, fn *lua.LFunction) {
-	client.On(L, "message", L.NewFunction(func(L *lua.LState) int {
-		e := L.CheckUserData(1).Value.(*slack.MessageEvent)
-		matches := pattern.FindAllStringSubmatch(e.Text, -1)
-		mentionMe, _ := regexp.MatchString("<@"+client.userId+"[^>]*>", e.Text)
-		if (e.SubType == "me_message" || len(e.SubType) == 0) && len(matches) != 0 && mentionMe {
-			user := client.userId2Name[e.User]
-			channel := "#" + client.channelId2Name[e.Channel]
-			pushN(L, fn, luar.New(L, matches[0]), luar.New(L, NewMessageEvent(user, channel, e.Text, e)))
-			if err := L.PCall(2, 0, nil); err != nil {
-				client.logger.Printf("[ERROR] %s", err.Error())
-			}
-		}
-		return 0
-	}))
+	client.handlers.Respond(pattern, fn)
 }
 
 func (client *slackChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
@@ -141,18 +174,20 @@ func (client *slackChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
 	for {
 		select {
 		case msg := <-rtm.IncomingEvents:
-			client.applyCallback(L, &msg)
+			client.applyCallback(&msg)
+			connection, reason := "", ""
+			client.names.Lock()
 			switch ev := msg.Data.(type) {
 			case *slack.ChannelCreatedEvent:
-				client.logger.Printf("[Info] Channel created : %s(ID:%s)", ev.Channel.Name, ev.Channel.ID)
+				client.logger.Printf("[INFO] Channel created : %s(ID:%s)", ev.Channel.Name, ev.Channel.ID)
 				client.channelName2Id[ev.Channel.Name] = ev.Channel.ID
 				client.channelId2Name[ev.Channel.ID] = ev.Channel.Name
 			case *slack.ChannelRenameEvent:
-				client.logger.Printf("[Info] Channel renamed: ID:%s %s -> %s", ev.Channel.ID, client.channelId2Name[ev.Channel.ID], ev.Channel.Name)
+				client.logger.Printf("[INFO] Channel renamed: ID:%s %s -> %s", ev.Channel.ID, client.channelId2Name[ev.Channel.ID], ev.Channel.Name)
 				delete(client.channelName2Id, client.channelId2Name[ev.Channel.ID])
 				client.channelName2Id[ev.Channel.Name] = ev.Channel.ID
 			case *slack.ChannelDeletedEvent:
-				client.logger.Printf("[Info] Channel deleted: %s(ID:%s)", client.channelId2Name[ev.Channel], ev.Channel)
+				client.logger.Printf("[INFO] Channel deleted: %s(ID:%s)", client.channelId2Name[ev.Channel], ev.Channel)
 				delete(client.channelName2Id, client.channelId2Name[ev.Channel])
 				delete(client.channelId2Name, ev.Channel)
 
@@ -168,18 +203,28 @@ func (client *slackChatClient) Serve(L *lua.LState, fn *lua.LFunction) {
 					client.userName2Id[u.Name] = u.ID
 					client.userId2Name[u.ID] = u.Name
 				}
-				client.logger.Printf("[Info] Connected to %s(channels:%s)", ev.Info.Team.Domain, strings.Join(channels, ","))
-				client.logger.Printf("[Info] My name is %s(ID:%s)", ev.Info.User.Name, client.userId)
+				client.logger.Printf("[INFO] Connected to %s(channels:%s)", ev.Info.Team.Domain, strings.Join(channels, ","))
+				client.logger.Printf("[INFO] My name is %s(ID:%s)", ev.Info.User.Name, client.userId)
+				connection = "connected"
+			case *slack.DisconnectedEvent:
+				connection = "disconnected"
+				if ev.Intentional {
+					reason = "intentional"
+				}
 			default:
 				// Ignore other events..
 			}
+			client.names.Unlock()
+			if len(connection) != 0 {
+				emitConnectionEvent(client, connection, reason)
+			}
 		case msg := <-luaMainChan:
-			func() {
-				mutex.Lock()
-				defer mutex.Unlock()
-				pushN(L, fn, msg)
-				L.PCall(1, 0, nil)
-			}()
+			callServe(msg)
+		case <-shutdownChan:
+			if err := rtm.Disconnect(); err != nil {
+				client.logger.Printf("[ERROR] %s", err.Error())
+			}
+			return
 		}
 	}
 }
@@ -195,14 +240,19 @@ func newSlackChatClient(L *lua.LState, co *CommonClientOption, opt *lua.LTable)
 	}
 
 	slackobj := slack.New(token)
-	chatClient := &slackChatClient{slackobj, nil, co, co.Logger, "", 0, make(map[string][]*lua.LFunction), make(map[string]string), make(map[string]string), make(map[string]string), make(map[string]string)}
-
-	if co.Logger == nil {
-		slack.SetLogger(log.New(os.Stdout, "", log.Lshortfile|log.LstdFlags))
-	} else {
-		slack.SetLogger(co.Logger)
+	chatClient := &slackChatClient{
+		slackobj:       slackobj,
+		commonOption:   co,
+		logger:         co.Logger,
+		handlers:       newChatHandlers(),
+		userId2Name:    make(map[string]string),
+		userName2Id:    make(map[string]string),
+		channelId2Name: make(map[string]string),
+		channelName2Id: make(map[string]string),
 	}
 
+	slack.SetLogger(co.Logger)
+
 	chatClient.rtm = chatClient.slackobj.NewRTM()
 	L.Push(newChatClient(L, slackChatClientTypeName, chatClient, luar.New(L, chatClient.rtm).(*lua.LUserData)))
 }
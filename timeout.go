@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+var handlerKinds = []string{"on", "respond", "serve", "http", "cron"}
+
+// handlerTimeoutConfig holds execution deadlines for Lua handlers. Deadlines are
+// enforced through the context of Lua states, so handlers are stopped even if
+// they hold the global mutex.
+type handlerTimeoutConfig struct {
+	sync.RWMutex
+	durations map[string]time.Duration
+	reply     string
+}
+
+var handlerTimeouts = &handlerTimeoutConfig{durations: make(map[string]time.Duration)}
+
+type handlerTimeoutError struct {
+	kind     string
+	duration time.Duration
+}
+
+func (e *handlerTimeoutError) Error() string {
+	return fmt.Sprintf("%s handler timed out after %s", e.kind, e.duration)
+}
+
+func (c *handlerTimeoutConfig) Get(kind string) time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.durations[kind]
+}
+
+func (c *handlerTimeoutConfig) Set(kind string, d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.durations[kind] = d
+}
+
+func (c *handlerTimeoutConfig) Reply() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.reply
+}
+
+// withTimeout calls fn with the deadline for the kind of handler set to the
+// context of L.
+func withTimeout(L *lua.LState, kind string, fn func() error) error {
+	return withDeadline(L, kind, handlerTimeouts.Get(kind), fn)
+}
+
+func withDeadline(L *lua.LState, kind string, d time.Duration, fn func() error) (err error) {
+	defer func(started time.Time) { observeHandler(kind, started, err) }(time.Now())
+	if d <= 0 {
+		return fn()
+	}
+	parent := L.Context()
+	base := parent
+	if base == nil {
+		base = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(base, d)
+	defer cancel()
+	L.SetContext(ctx)
+	err = fn()
+	if parent != nil {
+		L.SetContext(parent)
+	} else {
+		L.RemoveContext()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded && (parent == nil || parent.Err() == nil) {
+		return &handlerTimeoutError{kind, d}
+	}
+	return err
+}
+
+// pcallWithTimeout calls the handler and rolls back transactions it did not
+// finish.
+func pcallWithTimeout(L *lua.LState, kind string, nargs, nret int) error {
+	defer databases.Rollback(L, false)
+	return withTimeout(L, kind, func() error {
+		return L.PCall(nargs, nret, nil)
+	})
+}
+
+// replyTimeout tells the user that the respond callback timed out if the
+// reply message is configured.
+func replyTimeout(client ChatClient, target string, err error) {
+	if _, ok := err.(*handlerTimeoutError); ok {
+		if message := handlerTimeouts.Reply(); len(message) != 0 {
+			reply(client, target, message)
+		}
+	}
+}
+
+func loadTimeoutOption(L *lua.LState, tbl *lua.LTable) {
+	for _, kind := range handlerKinds {
+		if n, ok := getNumberField(L, tbl, kind); ok {
+			handlerTimeouts.Set(kind, time.Duration(n*float64(time.Second)))
+		}
+	}
+	if s, ok := getStringField(L, tbl, "reply"); ok {
+		handlerTimeouts.Lock()
+		handlerTimeouts.reply = s
+		handlerTimeouts.Unlock()
+	}
+}
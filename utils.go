@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -33,6 +34,26 @@ func getNumberField(L *lua.LState, t lua.LValue, key string) (float64, bool) {
 	return 0, false
 }
 
+// luaFingerprint returns a string that is equal for equal values, even if they
+// belong to different Lua states. Functions are compared by their definitions.
+func luaFingerprint(lv lua.LValue) string {
+	switch v := lv.(type) {
+	case *lua.LTable:
+		fields := []string{}
+		v.ForEach(func(key, value lua.LValue) {
+			fields = append(fields, luaFingerprint(key)+"="+luaFingerprint(value))
+		})
+		sort.Strings(fields)
+		return "{" + strings.Join(fields, ",") + "}"
+	case *lua.LFunction:
+		if v.Proto != nil {
+			return fmt.Sprintf("function:%s:%d", v.Proto.SourceName, v.Proto.LineDefined)
+		}
+		return "function"
+	}
+	return lv.Type().String() + ":" + lv.String()
+}
+
 func luaToXml(lvalue lua.LValue) string {
 	buf := []string{}
 	return strings.Join(_luaToXml(lvalue, buf), " ")
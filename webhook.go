@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// webhookEvent is a provider independent representation of webhook payloads.
+type webhookEvent map[string]interface{}
+
+var webhookTemplates = map[string]string{
+	"push": `[{{.repository}}] {{.user}} pushed {{len .commits}} commit(s) to {{.branch}}: {{.url}}` +
+		`{{range $i, $c := .commits}}{{if lt $i 5}}
+  {{$c.short_id}} {{$c.title}} - {{$c.author}}{{end}}{{end}}`,
+	"pull_request": `[{{.repository}}] {{.user}} {{.action}} pull request #{{.number}}: {{.title}} ({{.source_branch}} -> {{.target_branch}}) {{.url}}`,
+	"issues":       `[{{.repository}}] {{.user}} {{.action}} issue #{{.number}}: {{.title}} {{.url}}`,
+	"pipeline":     `[{{.repository}}] pipeline {{.name}} {{.status}} on {{.branch}}: {{.url}}`,
+	"release":      `[{{.repository}}] {{.user}} {{.action}} release {{.tag}}{{if .name}} {{.name}}{{end}}: {{.url}}`,
+}
+
+var parsedWebhookTemplates = map[string]*template.Template{}
+
+func init() {
+	for name, text := range webhookTemplates {
+		parsedWebhookTemplates[name] = template.Must(template.New(name).Parse(text))
+	}
+}
+
+func formatWebhookEvent(tmpl *template.Template, e webhookEvent) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, map[string]interface{}(e)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// jsonPath returns a value in the decoded JSON object, or nil if not found.
+func jsonPath(obj interface{}, path string) interface{} {
+	cur := obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[key]
+	}
+	return cur
+}
+
+func jsonString(obj interface{}, paths ...string) string {
+	for _, path := range paths {
+		switch v := jsonPath(obj, path).(type) {
+		case string:
+			if len(v) != 0 {
+				return v
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// jsonInt returns an integer such as an id. Templates print large float64
+// values in e-notation(9.87654321e+08), so ids are stored as integers.
+func jsonInt(obj interface{}, path string) int64 {
+	v, _ := jsonPath(obj, path).(float64)
+	return int64(v)
+}
+
+func jsonArray(obj interface{}, path string) []interface{} {
+	v, _ := jsonPath(obj, path).([]interface{})
+	return v
+}
+
+func shortId(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+// parseWebhook parses a payload of the provider("github" or "gitlab").
+// It returns nil if the event type is not supported.
+func parseWebhook(provider, name string, body []byte) (webhookEvent, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	var e webhookEvent
+	switch provider {
+	case "github":
+		e = parseGitHubEvent(name, payload)
+	case "gitlab":
+		if len(name) == 0 {
+			name = jsonString(payload, "object_kind")
+		}
+		e = parseGitLabEvent(name, payload)
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", provider)
+	}
+	if e != nil {
+		e["provider"] = provider
+		e["raw"] = payload
+	}
+	return e, nil
+}
+
+func parseGitHubEvent(name string, p map[string]interface{}) webhookEvent {
+	e := webhookEvent{
+		"repository": jsonString(p, "repository.full_name"),
+		"user":       jsonString(p, "sender.login"),
+		"action":     jsonString(p, "action"),
+	}
+	switch name {
+	case "push":
+		e["event"] = "push"
+		e["ref"] = jsonString(p, "ref")
+		e["branch"] = strings.TrimPrefix(strings.TrimPrefix(jsonString(p, "ref"), "refs/heads/"), "refs/tags/")
+		e["before"] = jsonString(p, "before")
+		e["after"] = jsonString(p, "after")
+		e["url"] = jsonString(p, "compare")
+		commits := []interface{}{}
+		for _, c := range jsonArray(p, "commits") {
+			commits = append(commits, map[string]interface{}{
+				"id":       jsonString(c, "id"),
+				"short_id": shortId(jsonString(c, "id")),
+				"title":    firstLine(jsonString(c, "message")),
+				"message":  jsonString(c, "message"),
+				"author":   jsonString(c, "author.username", "author.name"),
+				"url":      jsonString(c, "url"),
+			})
+		}
+		e["commits"] = commits
+	case "pull_request":
+		e["event"] = "pull_request"
+		e["number"] = jsonInt(p, "pull_request.number")
+		e["title"] = jsonString(p, "pull_request.title")
+		e["url"] = jsonString(p, "pull_request.html_url")
+		e["state"] = jsonString(p, "pull_request.state")
+		e["merged"] = jsonPath(p, "pull_request.merged") == true
+		e["source_branch"] = jsonString(p, "pull_request.head.ref")
+		e["target_branch"] = jsonString(p, "pull_request.base.ref")
+		if e["action"] == "closed" && e["merged"] == true {
+			e["action"] = "merged"
+		}
+	case "issues":
+		e["event"] = "issues"
+		e["number"] = jsonInt(p, "issue.number")
+		e["title"] = jsonString(p, "issue.title")
+		e["url"] = jsonString(p, "issue.html_url")
+		e["state"] = jsonString(p, "issue.state")
+	case "workflow_run":
+		e["event"] = "pipeline"
+		e["id"] = jsonInt(p, "workflow_run.id")
+		e["name"] = jsonString(p, "workflow_run.name")
+		e["status"] = jsonString(p, "workflow_run.conclusion", "workflow_run.status")
+		e["branch"] = jsonString(p, "workflow_run.head_branch")
+		e["url"] = jsonString(p, "workflow_run.html_url")
+	case "release":
+		e["event"] = "release"
+		e["tag"] = jsonString(p, "release.tag_name")
+		e["name"] = jsonString(p, "release.name")
+		e["url"] = jsonString(p, "release.html_url")
+	default:
+		return nil
+	}
+	return e
+}
+
+func parseGitLabEvent(name string, p map[string]interface{}) webhookEvent {
+	e := webhookEvent{
+		"repository": jsonString(p, "project.path_with_namespace"),
+		"user":       jsonString(p, "user.username", "user_username", "user_name"),
+		"action":     jsonString(p, "object_attributes.action"),
+	}
+	switch name {
+	case "Push Hook", "Tag Push Hook", "push", "tag_push":
+		e["event"] = "push"
+		e["ref"] = jsonString(p, "ref")
+		e["branch"] = strings.TrimPrefix(strings.TrimPrefix(jsonString(p, "ref"), "refs/heads/"), "refs/tags/")
+		e["before"] = jsonString(p, "before")
+		e["after"] = jsonString(p, "after")
+		e["url"] = jsonString(p, "project.web_url") + "/-/compare/" + jsonString(p, "before") + "..." + jsonString(p, "after")
+		commits := []interface{}{}
+		for _, c := range jsonArray(p, "commits") {
+			commits = append(commits, map[string]interface{}{
+				"id":       jsonString(c, "id"),
+				"short_id": shortId(jsonString(c, "id")),
+				"title":    jsonString(c, "title"),
+				"message":  jsonString(c, "message"),
+				"author":   jsonString(c, "author.name"),
+				"url":      jsonString(c, "url"),
+			})
+		}
+		e["commits"] = commits
+	case "Merge Request Hook", "merge_request":
+		e["event"] = "pull_request"
+		e["number"] = jsonInt(p, "object_attributes.iid")
+		e["title"] = jsonString(p, "object_attributes.title")
+		e["url"] = jsonString(p, "object_attributes.url")
+		e["state"] = jsonString(p, "object_attributes.state")
+		e["merged"] = e["state"] == "merged"
+		e["source_branch"] = jsonString(p, "object_attributes.source_branch")
+		e["target_branch"] = jsonString(p, "object_attributes.target_branch")
+	case "Issue Hook", "issue":
+		e["event"] = "issues"
+		e["number"] = jsonInt(p, "object_attributes.iid")
+		e["title"] = jsonString(p, "object_attributes.title")
+		e["url"] = jsonString(p, "object_attributes.url")
+		e["state"] = jsonString(p, "object_attributes.state")
+	case "Pipeline Hook", "pipeline":
+		e["event"] = "pipeline"
+		e["id"] = jsonInt(p, "object_attributes.id")
+		e["name"] = "#" + jsonString(p, "object_attributes.id")
+		e["status"] = jsonString(p, "object_attributes.status")
+		e["branch"] = jsonString(p, "object_attributes.ref")
+		e["url"] = jsonString(p, "project.web_url") + "/-/pipelines/" + jsonString(p, "object_attributes.id")
+	case "Release Hook", "release":
+		e["event"] = "release"
+		e["tag"] = jsonString(p, "tag")
+		e["name"] = jsonString(p, "name")
+		e["url"] = jsonString(p, "url")
+	default:
+		return nil
+	}
+	return e
+}
+
+func webhookEventName(provider string, r *http.Request) string {
+	if provider == "github" {
+		return r.Header.Get("X-GitHub-Event")
+	}
+	return r.Header.Get("X-Gitlab-Event")
+}
+
+func webhookEventToLua(L *lua.LState, e webhookEvent) (lua.LValue, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return lua.LNil, err
+	}
+	return luajson.Decode(L, b)
+}
+
+// webhookChannels returns channels for the repository. "*" is used for
+// repositories not in the table.
+func webhookChannels(L *lua.LState, channels *lua.LTable, repository string) []string {
+	lv := channels.RawGetString(repository)
+	if lv == lua.LNil {
+		lv = channels.RawGetString("*")
+	}
+	switch v := lv.(type) {
+	case lua.LString:
+		return []string{string(v)}
+	case *lua.LTable:
+		result := []string{}
+		v.ForEach(func(_, ch lua.LValue) { result = append(result, ch.String()) })
+		return result
+	}
+	return nil
+}
+
+// webhookMessage formats the event with the format override or the default
+// template. It returns false if the event should not be notified.
+func webhookMessage(L *lua.LState, format *lua.LTable, e webhookEvent, le lua.LValue) (string, bool, error) {
+	name := e["event"].(string)
+	switch f := format.RawGetString(name).(type) {
+	case *lua.LFunction:
+		pushN(L, f, le)
+		L.Call(1, 1)
+		ret := L.Get(-1)
+		L.Pop(1)
+		if s, ok := ret.(lua.LString); ok {
+			return string(s), true, nil
+		}
+		return "", false, nil
+	case lua.LString:
+		tmpl, err := template.New(name).Parse(string(f))
+		if err != nil {
+			return "", false, err
+		}
+		s, err := formatWebhookEvent(tmpl, e)
+		return s, err == nil, err
+	case *lua.LNilType:
+		s, err := formatWebhookEvent(parsedWebhookTemplates[name], e)
+		return s, err == nil, err
+	}
+	return "", false, nil
+}
+
+// webhookHandler returns a route handler that posts events to channels.
+func webhookHandler(L *lua.LState, provider string, opt *lua.LTable) *lua.LFunction {
+	channels, ok := L.GetField(opt, "channels").(*lua.LTable)
+	if !ok {
+		channels = L.NewTable()
+	}
+	format, ok := L.GetField(opt, "format").(*lua.LTable)
+	if !ok {
+		format = L.NewTable()
+	}
+	events := map[string]bool{}
+	if tbl, ok := L.GetField(opt, "events").(*lua.LTable); ok {
+		tbl.ForEach(func(_, v lua.LValue) { events[v.String()] = true })
+	}
+	return L.NewFunction(func(L *lua.LState) int {
+		r := L.CheckUserData(1).Value.(*http.Request)
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			pushN(L, lua.LNumber(bodyErrorStatus(err)), L.NewTable(), lua.LString(err.Error()))
+			return 3
+		}
+		e, err := parseWebhook(provider, webhookEventName(provider, r), body)
+		if err != nil {
+			pushN(L, lua.LNumber(http.StatusBadRequest), L.NewTable(), lua.LString(err.Error()))
+			return 3
+		}
+		if e == nil || (len(events) != 0 && !events[e["event"].(string)]) {
+			pushN(L, lua.LNumber(http.StatusOK), L.NewTable(), lua.LString("ignored"))
+			return 3
+		}
+		le, err := webhookEventToLua(L, e)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		message, ok, err := webhookMessage(L, format, e, le)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		if ok {
+			for _, channel := range webhookChannels(L, channels, e["repository"].(string)) {
+				if _, err := sayMain(channel, message); err != nil {
+					L.RaiseError(err.Error())
+				}
+			}
+		}
+		pushN(L, lua.LNumber(http.StatusOK), L.NewTable(), lua.LString("ok"))
+		return 3
+	})
+}
+
+var webhookMod = map[string]lua.LGFunction{
+	"route": func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		opt := L.CheckTable(2)
+		provider, _ := getStringField(L, opt, "provider")
+		if provider != "github" && provider != "gitlab" {
+			L.ArgError(2, "provider must be 'github' or 'gitlab'")
+		}
+		route := newHttpRoute(L, "POST", pattern)
+		if lv := L.GetField(opt, "auth"); lv != lua.LNil {
+			route.auth = loadHttpAuths(L, lv)
+		} else if s, ok := getStringField(L, opt, "secret"); ok {
+			tbl := L.NewTable()
+			tbl.RawSetString("secret", lua.LString(s))
+			tbl.RawSetString("token", lua.LString(s))
+			if provider == "github" {
+				tbl.RawSetString("type", lua.LString("github"))
+			} else {
+				tbl.RawSetString("type", lua.LString("gitlab"))
+			}
+			route.auth = []*httpAuth{loadHttpAuth(L, tbl)}
+		}
+		chain := L.NewTable()
+		chain.Append(webhookHandler(L, provider, opt))
+		addRoute(L, route, chain)
+		return 0
+	},
+	"parse": func(L *lua.LState) int {
+		e, err := parseWebhook(L.CheckString(1), L.CheckString(2), []byte(L.CheckString(3)))
+		if err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		if e == nil {
+			pushN(L, lua.LNil, lua.LString("unsupported event"))
+			return 2
+		}
+		le, err := webhookEventToLua(L, e)
+		if err != nil {
+			pushN(L, lua.LNil, lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(le)
+		return 1
+	},
+	"format": func(L *lua.LState) int {
+		b, err := luajson.Encode(L.CheckTable(1))
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+		// numbers are kept as written so that large ids are not formatted in
+		// exponential notation
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		var e webhookEvent
+		if err := d.Decode(&e); err != nil {
+			L.ArgError(1, err.Error())
+		}
+		name, _ := e["event"].(string)
+		tmpl, ok := parsedWebhookTemplates[name]
+		if !ok {
+			L.ArgError(1, "unknown event: "+name)
+		}
+		s, err := formatWebhookEvent(tmpl, e)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(lua.LString(s))
+		return 1
+	},
+}
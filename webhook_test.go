@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestJsonString(t *testing.T) {
+	obj := map[string]interface{}{
+		"id":    float64(987654321),
+		"ratio": 1.5,
+		"name":  "golbot",
+		"empty": "",
+		"user":  map[string]interface{}{"name": "alice"},
+	}
+	cases := []struct {
+		paths    []string
+		expected string
+	}{
+		{[]string{"id"}, "987654321"},
+		{[]string{"ratio"}, "1.5"},
+		{[]string{"name"}, "golbot"},
+		{[]string{"user.name"}, "alice"},
+		{[]string{"empty", "user.name"}, "alice"},
+		{[]string{"missing", "name"}, "golbot"},
+		{[]string{"user.missing.name"}, ""},
+	}
+	for _, c := range cases {
+		if s := jsonString(obj, c.paths...); s != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.paths, c.expected, s)
+		}
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	cases := []struct {
+		provider string
+		name     string
+		body     string
+		fields   map[string]interface{}
+		message  string
+	}{
+		{"github", "push", `{
+		  "ref": "refs/heads/master", "before": "a", "after": "b", "compare": "https://github.com/yuin/golbot/compare/a...b",
+		  "repository": {"full_name": "yuin/golbot"}, "sender": {"login": "yuin"},
+		  "commits": [{"id": "0123456789abcdef", "message": "fix a bug\n\ndetails", "author": {"username": "yuin"}, "url": "u"}]}`,
+			map[string]interface{}{"event": "push", "branch": "master", "repository": "yuin/golbot", "user": "yuin"},
+			"[yuin/golbot] yuin pushed 1 commit(s) to master: https://github.com/yuin/golbot/compare/a...b\n  01234567 fix a bug - yuin"},
+		{"github", "pull_request", `{
+		  "action": "closed", "repository": {"full_name": "yuin/golbot"}, "sender": {"login": "yuin"},
+		  "pull_request": {"number": 12, "title": "add tests", "html_url": "u", "state": "closed", "merged": true,
+		    "head": {"ref": "tests"}, "base": {"ref": "master"}}}`,
+			map[string]interface{}{"event": "pull_request", "action": "merged", "number": int64(12), "merged": true},
+			"[yuin/golbot] yuin merged pull request #12: add tests (tests -> master) u"},
+		{"github", "workflow_run", `{
+		  "repository": {"full_name": "yuin/golbot"},
+		  "workflow_run": {"id": 9876543210, "name": "ci", "status": "completed", "conclusion": "success", "head_branch": "master", "html_url": "u"}}`,
+			map[string]interface{}{"event": "pipeline", "id": int64(9876543210), "status": "success"},
+			"[yuin/golbot] pipeline ci success on master: u"},
+		{"gitlab", "", `{
+		  "object_kind": "pipeline", "project": {"path_with_namespace": "yuin/golbot", "web_url": "https://gitlab.com/yuin/golbot"},
+		  "object_attributes": {"id": 1234567890, "status": "failed", "ref": "master"}}`,
+			map[string]interface{}{"event": "pipeline", "id": int64(1234567890), "name": "#1234567890"},
+			"[yuin/golbot] pipeline #1234567890 failed on master: https://gitlab.com/yuin/golbot/-/pipelines/1234567890"},
+		{"gitlab", "Merge Request Hook", `{
+		  "project": {"path_with_namespace": "yuin/golbot"}, "user": {"username": "yuin"},
+		  "object_attributes": {"iid": 3, "title": "add tests", "url": "u", "state": "merged", "action": "merge",
+		    "source_branch": "tests", "target_branch": "master"}}`,
+			map[string]interface{}{"event": "pull_request", "number": int64(3), "merged": true},
+			"[yuin/golbot] yuin merge pull request #3: add tests (tests -> master) u"},
+	}
+	for _, c := range cases {
+		e, err := parseWebhook(c.provider, c.name, []byte(c.body))
+		if err != nil || e == nil {
+			t.Errorf("%s %s: unexpected result: %v %v", c.provider, c.name, e, err)
+			continue
+		}
+		for key, expected := range c.fields {
+			if e[key] != expected {
+				t.Errorf("%s %s: expected %s=%v(%T), got %v(%T)", c.provider, c.name, key, expected, expected, e[key], e[key])
+			}
+		}
+		message, err := formatWebhookEvent(parsedWebhookTemplates[e["event"].(string)], e)
+		if err != nil {
+			t.Errorf("%s %s: %s", c.provider, c.name, err.Error())
+		} else if message != c.message {
+			t.Errorf("%s %s: expected %q, got %q", c.provider, c.name, c.message, message)
+		}
+	}
+}
+
+func TestParseWebhookUnsupported(t *testing.T) {
+	if e, err := parseWebhook("github", "star", []byte(`{}`)); e != nil || err != nil {
+		t.Errorf("expected nil for unsupported events, got %v %v", e, err)
+	}
+	if _, err := parseWebhook("bitbucket", "push", []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "unknown provider") {
+		t.Errorf("expected an error for unknown providers, got %v", err)
+	}
+	if _, err := parseWebhook("github", "push", []byte(`{`)); err == nil {
+		t.Errorf("expected an error for invalid JSON")
+	}
+}
+
+func TestWebhookFormat(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("format", L.NewFunction(webhookMod["format"]))
+	if err := L.DoString(`
+	  message = format({event = "pipeline", repository = "yuin/golbot", name = "#1234567890",
+	    id = 1234567890, status = "success", branch = "master", url = "u"})
+	  pr = format({event = "pull_request", repository = "yuin/golbot", user = "yuin", action = "opened",
+	    number = 10000000, title = "t", source_branch = "a", target_branch = "b", url = "u"})
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if message := L.GetGlobal("message").String(); message != "[yuin/golbot] pipeline #1234567890 success on master: u" {
+		t.Errorf("unexpected message: %q", message)
+	}
+	if message := L.GetGlobal("pr").String(); message != "[yuin/golbot] yuin opened pull request #10000000: t (a -> b) u" {
+		t.Errorf("large numbers must not be formatted in exponential notation: %q", message)
+	}
+}
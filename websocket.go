@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	liveEventBufferSize = 64
+	websocketPingPeriod = 30 * time.Second
+	websocketPongWait   = 60 * time.Second
+	websocketWriteWait  = 10 * time.Second
+)
+
+// liveEvent is a normalized chat event streamed to websocket subscribers.
+type liveEvent struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel,omitempty"`
+	ChannelId string `json:"channel_id,omitempty"`
+	User      string `json:"user,omitempty"`
+	UserId    string `json:"user_id,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+func newMessageLiveEvent(typ string, e *MessageEvent) *liveEvent {
+	return &liveEvent{
+		Type:      typ,
+		Channel:   e.Target,
+		ChannelId: e.ChannelId,
+		User:      e.From,
+		UserId:    e.UserId,
+		Text:      e.Message,
+	}
+}
+
+type liveSubscriber struct {
+	events chan *liveEvent
+	// nil means all channels
+	channels map[string]bool
+}
+
+// Accepts returns true if the subscriber watches the channel. Events without
+// channels such as connection events are sent to all subscribers.
+func (s *liveSubscriber) Accepts(e *liveEvent) bool {
+	return s.channels == nil || len(e.Channel) == 0 || s.channels[e.Channel] || s.channels[e.ChannelId]
+}
+
+// eventHub broadcasts live events to websocket subscribers. Events are dropped
+// for subscribers that do not read them fast enough.
+type eventHub struct {
+	sync.Mutex
+	subscribers map[*liveSubscriber]bool
+	closed      bool
+}
+
+var liveEvents = &eventHub{subscribers: map[*liveSubscriber]bool{}}
+
+func (h *eventHub) Subscribe(channels map[string]bool) *liveSubscriber {
+	h.Lock()
+	defer h.Unlock()
+	s := &liveSubscriber{make(chan *liveEvent, liveEventBufferSize), channels}
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	h.subscribers[s] = true
+	return s
+}
+
+func (h *eventHub) Unsubscribe(s *liveSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	if h.subscribers[s] {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+func (h *eventHub) SetChannels(s *liveSubscriber, channels map[string]bool) {
+	h.Lock()
+	defer h.Unlock()
+	s.channels = channels
+}
+
+func (h *eventHub) Publish(e *liveEvent) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+	e.Time = time.Now().Unix()
+	for s := range h.subscribers {
+		if !s.Accepts(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+}
+
+// Close disconnects all subscribers.
+func (h *eventHub) Close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// websocketOption configures the websocket endpoint.
+type websocketOption struct {
+	Path string
+	Auth []*httpAuth
+	// channels that subscribers can watch and say to, empty means all channels
+	Channels map[string]bool
+	Origins  map[string]bool
+	Say      bool
+}
+
+// AllowedChannels returns channels that a subscriber watches. If no channels
+// are requested, the subscriber watches all allowed channels.
+func (o *websocketOption) AllowedChannels(names []string) map[string]bool {
+	channels := map[string]bool{}
+	requested := false
+	for _, name := range names {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		requested = true
+		if len(o.Channels) == 0 || o.Channels[name] {
+			channels[name] = true
+		}
+	}
+	if requested {
+		return channels
+	}
+	if len(o.Channels) == 0 {
+		return nil
+	}
+	return o.Channels
+}
+
+func (o *websocketOption) CanSay(channel string) bool {
+	return o.Say && (len(o.Channels) == 0 || o.Channels[channel])
+}
+
+func loadWebsocketOption(L *lua.LState, tbl *lua.LTable) *websocketOption {
+	o := &websocketOption{Path: "/ws", Channels: map[string]bool{}, Origins: map[string]bool{}, Say: true}
+	if s, ok := getStringField(L, tbl, "path"); ok {
+		o.Path = s
+	}
+	o.Auth = loadHttpAuths(L, L.GetField(tbl, "auth"))
+	if len(o.Auth) == 0 {
+		L.RaiseError("websocket: 'auth' is required")
+	}
+	if channels, ok := L.GetField(tbl, "channels").(*lua.LTable); ok {
+		channels.ForEach(func(_, v lua.LValue) { o.Channels[v.String()] = true })
+	}
+	if origins, ok := L.GetField(tbl, "origins").(*lua.LTable); ok {
+		origins.ForEach(func(_, v lua.LValue) { o.Origins[v.String()] = true })
+	}
+	if v, ok := L.GetField(tbl, "say").(lua.LBool); ok {
+		o.Say = bool(v)
+	}
+	return o
+}
+
+// websocketCommand is a message sent by websocket clients.
+type websocketCommand struct {
+	Type     string   `json:"type"`
+	Id       string   `json:"id,omitempty"`
+	Channel  string   `json:"channel"`
+	Text     string   `json:"text"`
+	Channels []string `json:"channels"`
+}
+
+type websocketResult struct {
+	Type   string `json:"type"`
+	Id     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func serveWebsocket(w http.ResponseWriter, r *http.Request, o *websocketOption, logger *log.Logger) {
+	upgrader := websocket.Upgrader{}
+	if len(o.Origins) != 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool { return o.Origins[r.Header.Get("Origin")] }
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Printf("[WARN] websocket %s: %s", r.RemoteAddr, err.Error())
+		return
+	}
+	defer conn.Close()
+	sub := liveEvents.Subscribe(o.AllowedChannels(strings.Split(r.URL.Query().Get("channels"), ",")))
+	defer liveEvents.Unsubscribe(sub)
+	logger.Printf("[INFO] websocket %s: connected", r.RemoteAddr)
+
+	results := make(chan *websocketResult, 8)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(done)
+		conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			cmd := &websocketCommand{}
+			res := &websocketResult{Type: "error"}
+			if err := json.Unmarshal(data, cmd); err != nil {
+				res.Error = err.Error()
+			} else {
+				res = handleWebsocketCommand(sub, o, cmd)
+			}
+			select {
+			case results <- res:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(websocketPingPeriod)
+	defer ticker.Stop()
+	for {
+		var v interface{}
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(websocketWriteWait))
+				return
+			}
+			v = e
+		case res := <-results:
+			v = res
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteWait)); err != nil {
+				return
+			}
+			continue
+		case <-done:
+			logger.Printf("[INFO] websocket %s: disconnected", r.RemoteAddr)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+		if err := conn.WriteJSON(v); err != nil {
+			return
+		}
+	}
+}
+
+func handleWebsocketCommand(sub *liveSubscriber, o *websocketOption, cmd *websocketCommand) *websocketResult {
+	res := &websocketResult{Type: "result", Id: cmd.Id}
+	switch cmd.Type {
+	case "say":
+		if !o.CanSay(cmd.Channel) {
+			res.Error = "permission denied"
+			return res
+		}
+		status, err := sayMain(cmd.Channel, cmd.Text)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Status = status
+	case "subscribe":
+		liveEvents.SetChannels(sub, o.AllowedChannels(cmd.Channels))
+		res.Status = "ok"
+	default:
+		res.Error = "unknown command: " + cmd.Type
+	}
+	return res
+}